@@ -0,0 +1,437 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const apiPrefix = "/api/v1"
+
+type apiParam struct {
+	name        string
+	in          string
+	kind        string
+	description string
+}
+
+type apiRoute struct {
+	method     string
+	path       string
+	summary    string
+	params     []apiParam
+	request    interface{}
+	response   interface{}
+	produces   []string
+	admin      bool
+	identified bool
+	notFound   string
+	handler    http.HandlerFunc
+}
+
+type legacyRoute struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+func apiRoutes() []apiRoute {
+	var exportTypes []string
+	for _, format := range exportFormats {
+		exportTypes = append(exportTypes, format.contentType)
+	}
+
+	sort.Strings(exportTypes)
+
+	routes := []apiRoute{
+		{
+			method:   http.MethodPost,
+			path:     "/query",
+			summary:  "Search and score restaurants",
+			request:  queryRequest{},
+			response: queryResponse{},
+			handler:  handleExecuteQuery,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/clusters",
+			summary:  "Search and group matches into map clusters",
+			request:  clusterRequest{},
+			response: clusterResponse{},
+			handler:  handleGetClusters,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/export",
+			summary:  "Search and export matches as GeoJSON, the default, or KML",
+			request:  exportRequest{},
+			produces: exportTypes,
+			handler:  handleExportQuery,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/restaurants/{id}",
+			summary: "Fetch a single restaurant with its features, stations, history and sources",
+			params: []apiParam{
+				{"id", "path", "integer", "Restaurant id"},
+				{"profileId", "query", "integer", "Saved profile used for compatibility"},
+				{"stations", "query", "integer", "Number of nearest stations"},
+			},
+			response: restaurantDetail{},
+			notFound: "Unknown restaurant",
+			handler:  handleGetRestaurant,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/categories",
+			summary:  "List profile categories",
+			params:   []apiParam{{"archived", "query", "boolean", "Include archived categories"}},
+			response: []category{},
+			handler:  handleGetCategories,
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/categories",
+			summary:    "Add a profile category",
+			request:    addCategoryRequest{},
+			response:   addCategoryResponse{},
+			identified: true,
+			handler:    requireUser(handleAddCategory),
+		},
+		{
+			method:  http.MethodDelete,
+			path:    "/categories/{id}",
+			summary: "Remove or archive a profile category",
+			params: []apiParam{
+				{"id", "path", "integer", "Category id"},
+				{"archive", "query", "boolean", "Archive the category instead of deleting it"},
+			},
+			response:   successResponse{},
+			identified: true,
+			handler:    requireUser(handleRemoveCategory),
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/categories/update",
+			summary:    "Update a profile category",
+			request:    updateCategoryRequest{},
+			response:   successResponse{},
+			identified: true,
+			handler:    requireUser(handleUpdateCategory),
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/categories/reorder",
+			summary:    "Reorder profile categories",
+			request:    reorderCategoriesRequest{},
+			response:   successResponse{},
+			identified: true,
+			handler:    requireUser(handleReorderCategories),
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/access",
+			summary:    "Record that a restaurant was viewed",
+			request:    accessRequest{},
+			identified: true,
+			handler:    requireUser(handleAccessReview),
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/feedback",
+			summary:    "Record explicit feedback on a restaurant",
+			request:    feedbackRequest{},
+			response:   successResponse{},
+			identified: true,
+			handler:    requireUser(handleFeedbackReview),
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/history",
+			summary: "List history entries",
+			params: []apiParam{
+				{"from", "query", "string", "Earliest entry date, as RFC 3339 or YYYY-MM-DD in UTC"},
+				{"to", "query", "string", "Latest entry date, as RFC 3339 or YYYY-MM-DD in UTC"},
+				{"reviewId", "query", "integer", "Restrict to one restaurant"},
+				{"limit", "query", "integer", "Maximum number of entries"},
+				{"offset", "query", "integer", "Number of entries to skip"},
+			},
+			response: historyResponse{},
+			handler:  handleGetHistory,
+		},
+		{
+			method:     http.MethodDelete,
+			path:       "/history",
+			summary:    "Clear all history entries",
+			produces:   []string{"text/plain"},
+			identified: true,
+			handler:    requireUser(handleClearHistory),
+		},
+		{
+			method:  http.MethodDelete,
+			path:    "/history/range",
+			summary: "Remove history entries within a date range",
+			params: []apiParam{
+				{"from", "query", "string", "Earliest date to remove, as RFC 3339 or YYYY-MM-DD in UTC"},
+				{"to", "query", "string", "Latest date to remove, as RFC 3339 or YYYY-MM-DD in UTC"},
+				{"reviewId", "query", "integer", "Only remove entries for this restaurant"},
+			},
+			response:   historyRangeResponse{},
+			identified: true,
+			handler:    requireUser(handleRemoveHistoryRange),
+		},
+		{
+			method:     http.MethodDelete,
+			path:       "/history/{id}",
+			summary:    "Remove a single history entry",
+			params:     []apiParam{{"id", "path", "integer", "History entry id"}},
+			response:   successResponse{},
+			identified: true,
+			handler:    requireUser(handleRemoveHistoryEntry),
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/areas",
+			summary:  "List named search areas",
+			response: []string{},
+			handler:  handleGetAreas,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/profiles",
+			summary:  "List saved profiles",
+			response: []savedProfile{},
+			handler:  handleGetProfiles,
+		},
+		{
+			method:     http.MethodPost,
+			path:       "/profiles",
+			summary:    "Create or update a saved profile",
+			request:    saveProfileRequest{},
+			response:   saveProfileResponse{},
+			identified: true,
+			handler:    requireUser(handleSaveProfile),
+		},
+		{
+			method:     http.MethodDelete,
+			path:       "/profiles/{id}",
+			summary:    "Remove a saved profile",
+			params:     []apiParam{{"id", "path", "integer", "Profile id"}},
+			response:   successResponse{},
+			identified: true,
+			handler:    requireUser(handleRemoveProfile),
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/recommend",
+			summary:  "Recommend restaurants from collaborative filtering",
+			params:   []apiParam{{"limit", "query", "integer", "Maximum number of recommendations"}},
+			response: []recommendation{},
+			handler:  handleRecommend,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/suggest",
+			summary:  "Suggest feature values from history",
+			response: suggestion{},
+			handler:  handleSuggest,
+		},
+	}
+
+	// Administrative routes are only served when a token is configured.
+	if len(adminToken) > 0 {
+		routes = append(routes, apiRoute{
+			method:   http.MethodPost,
+			path:     "/admin/cf/refresh",
+			summary:  "Rebuild the collaborative filtering model",
+			response: cfStats{},
+			admin:    true,
+			handler:  requireAdmin(handleRefreshCF),
+		})
+	}
+
+	return routes
+}
+
+// legacyRoutes are the unversioned paths served before the /api/v1 namespace
+// existed; they remain for older clients but are restricted to one method.
+func legacyRoutes() []legacyRoute {
+	routes := []legacyRoute{
+		{http.MethodPost, "/query", handleExecuteQuery},
+		{http.MethodPost, "/clusters", handleGetClusters},
+		{http.MethodPost, "/export", handleExportQuery},
+		{http.MethodGet, "/categories", handleGetCategories},
+		{http.MethodPost, "/categories/update", requireUser(handleUpdateCategory)},
+		{http.MethodPost, "/categories/reorder", requireUser(handleReorderCategories)},
+		{http.MethodPost, "/learn", requireUser(handleAddCategory)},
+		{http.MethodPost, "/forget", requireUser(handleRemoveCategory)},
+		{http.MethodPost, "/access", requireUser(handleAccessReview)},
+		{http.MethodPost, "/feedback", requireUser(handleFeedbackReview)},
+		{http.MethodPost, "/clear", requireUser(handleClearHistory)},
+		{http.MethodGet, "/history", handleGetHistory},
+		{http.MethodDelete, "/history/", requireUser(handleRemoveHistoryEntry)},
+		{http.MethodPost, "/history/range", requireUser(handleRemoveHistoryRange)},
+		{http.MethodGet, "/areas", handleGetAreas},
+		{http.MethodGet, "/profiles", handleGetProfiles},
+		{http.MethodPost, "/profiles/save", requireUser(handleSaveProfile)},
+		{http.MethodPost, "/profiles/remove", requireUser(handleRemoveProfile)},
+		{http.MethodGet, "/recommend", handleRecommend},
+		{http.MethodGet, "/suggest", handleSuggest},
+	}
+
+	if len(adminToken) > 0 {
+		routes = append(routes, legacyRoute{http.MethodPost, "/admin/cf/refresh", requireAdmin(handleRefreshCF)})
+	}
+
+	return routes
+}
+
+func (r apiRoute) pattern() string {
+	if index := strings.Index(r.path, "{"); index >= 0 {
+		return apiPrefix + r.path[:index]
+	}
+
+	return apiPrefix + r.path
+}
+
+// pathId parses the id that ends the path of requests such as
+// DELETE /api/v1/categories/{id}.
+func pathId(req *http.Request) (int, error) {
+	value := path.Base(req.URL.Path)
+
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", value)
+	}
+
+	return id, nil
+}
+
+// isVersionedDelete reports whether a removal request uses the versioned
+// DELETE form, which passes its arguments in the path and query string, rather
+// than the legacy POST form, which sends them as a JSON body.
+func isVersionedDelete(req *http.Request) bool {
+	return req.Method == http.MethodDelete
+}
+
+// requireAdmin rejects requests that do not present the configured admin
+// token as a bearer credential.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+		if len(adminToken) == 0 || !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+// requireUser rejects anonymous requests, which must not modify the shared
+// categories or another client's history.
+func requireUser(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if len(requestUser(req)) == 0 {
+			http.Error(rw, "missing user id", http.StatusBadRequest)
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+func methodHandler(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	var allowed []string
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+
+	sort.Strings(allowed)
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+		handler, ok := handlers[req.Method]
+		if !ok && req.Method == http.MethodHead {
+			handler, ok = handlers[http.MethodGet]
+		}
+
+		if !ok {
+			rw.Header().Set("Allow", strings.Join(allowed, ", "))
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler(rw, req)
+	}
+}
+
+func registerAPI(mux *http.ServeMux) error {
+	routes := apiRoutes()
+
+	doc, err := json.Marshal(openAPIDocument(routes))
+	if err != nil {
+		return err
+	}
+
+	patterns := make(map[string]map[string]http.HandlerFunc)
+	add := func(pattern, method string, handler http.HandlerFunc) {
+		handlers, ok := patterns[pattern]
+		if !ok {
+			handlers = make(map[string]http.HandlerFunc)
+			patterns[pattern] = handlers
+		}
+
+		handlers[method] = handler
+	}
+
+	for _, route := range routes {
+		add(route.pattern(), route.method, route.handler)
+	}
+
+	for _, route := range legacyRoutes() {
+		add(route.path, route.method, route.handler)
+	}
+
+	add(apiPrefix+"/openapi.json", http.MethodGet, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(doc)
+	})
+
+	add("/metrics", http.MethodGet, handleMetrics)
+	add("/healthz", http.MethodGet, handleHealth)
+	add("/readyz", http.MethodGet, handleReadiness)
+
+	for pattern, handlers := range patterns {
+		mux.Handle(pattern, instrument(pattern, methodHandler(handlers)))
+	}
+
+	return nil
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+type geoBounds struct {
+	minLat, minLng float64
+	maxLat, maxLng float64
+}
+
+type geoRing []geoData
+
+type geoPolygon struct {
+	rings  []geoRing
+	bounds geoBounds
+}
+
+type geoArea struct {
+	polygons []geoPolygon
+	bounds   geoBounds
+}
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONObject struct {
+	Type        string           `json:"type"`
+	Coordinates json.RawMessage  `json:"coordinates"`
+	Geometry    *geoJSONGeometry `json:"geometry"`
+	Features    []geoJSONFeature `json:"features"`
+}
+
+func emptyBounds() geoBounds {
+	return geoBounds{
+		minLat: math.Inf(1),
+		minLng: math.Inf(1),
+		maxLat: math.Inf(-1),
+		maxLng: math.Inf(-1),
+	}
+}
+
+func (b *geoBounds) extend(other geoBounds) {
+	b.minLat = math.Min(b.minLat, other.minLat)
+	b.minLng = math.Min(b.minLng, other.minLng)
+	b.maxLat = math.Max(b.maxLat, other.maxLat)
+	b.maxLng = math.Max(b.maxLng, other.maxLng)
+}
+
+func (b geoBounds) contains(point geoData) bool {
+	return point.Latitude >= b.minLat && point.Latitude <= b.maxLat && point.Longitude >= b.minLng && point.Longitude <= b.maxLng
+}
+
+func (r geoRing) contains(point geoData) bool {
+	var inside bool
+
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		pi, pj := r[i], r[j]
+		if (pi.Latitude > point.Latitude) == (pj.Latitude > point.Latitude) {
+			continue
+		}
+
+		lng := pi.Longitude + (point.Latitude-pi.Latitude)*(pj.Longitude-pi.Longitude)/(pj.Latitude-pi.Latitude)
+		if point.Longitude < lng {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+func (p geoPolygon) contains(point geoData) bool {
+	if !p.bounds.contains(point) || !p.rings[0].contains(point) {
+		return false
+	}
+
+	for _, hole := range p.rings[1:] {
+		if hole.contains(point) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (a *geoArea) contains(point geoData) bool {
+	if !a.bounds.contains(point) {
+		return false
+	}
+
+	for _, polygon := range a.polygons {
+		if polygon.contains(point) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *geoArea) addPolygon(coords [][][]float64) error {
+	if len(coords) == 0 {
+		return errors.New("polygon has no rings")
+	}
+
+	polygon := geoPolygon{bounds: emptyBounds()}
+	for _, ringCoords := range coords {
+		if len(ringCoords) < 3 {
+			return errors.New("polygon ring has too few positions")
+		}
+
+		var ring geoRing
+		for _, position := range ringCoords {
+			if len(position) < 2 {
+				return errors.New("invalid polygon position")
+			}
+
+			point := geoData{Latitude: position[1], Longitude: position[0]}
+			polygon.bounds.extend(geoBounds{point.Latitude, point.Longitude, point.Latitude, point.Longitude})
+			ring = append(ring, point)
+		}
+
+		polygon.rings = append(polygon.rings, ring)
+	}
+
+	a.polygons = append(a.polygons, polygon)
+	a.bounds.extend(polygon.bounds)
+	return nil
+}
+
+func (a *geoArea) addGeometry(geometry geoJSONGeometry) error {
+	switch geometry.Type {
+	case "Polygon":
+		var coords [][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &coords); err != nil {
+			return err
+		}
+
+		return a.addPolygon(coords)
+	case "MultiPolygon":
+		var coords [][][][]float64
+		if err := json.Unmarshal(geometry.Coordinates, &coords); err != nil {
+			return err
+		}
+
+		for _, polygonCoords := range coords {
+			if err := a.addPolygon(polygonCoords); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unsupported geometry type %q", geometry.Type)
+	}
+}
+
+func parseArea(data []byte) (*geoArea, error) {
+	var object geoJSONObject
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+
+	area := &geoArea{bounds: emptyBounds()}
+
+	switch object.Type {
+	case "FeatureCollection":
+		for _, feature := range object.Features {
+			if feature.Geometry == nil {
+				continue
+			}
+
+			if err := area.addGeometry(*feature.Geometry); err != nil {
+				return nil, err
+			}
+		}
+	case "Feature":
+		if object.Geometry == nil {
+			return nil, errors.New("feature has no geometry")
+		}
+
+		if err := area.addGeometry(*object.Geometry); err != nil {
+			return nil, err
+		}
+	default:
+		if err := area.addGeometry(geoJSONGeometry{object.Type, object.Coordinates}); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(area.polygons) == 0 {
+		return nil, errors.New("area contains no polygons")
+	}
+
+	return area, nil
+}
+
+func loadAreas(filename string) (map[string]*geoArea, error) {
+	areas := make(map[string]*geoArea)
+
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return areas, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var collection struct {
+		Features []geoJSONFeature `json:"features"`
+	}
+
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, err
+	}
+
+	for _, feature := range collection.Features {
+		name, _ := feature.Properties["name"].(string)
+		if len(name) == 0 || feature.Geometry == nil {
+			continue
+		}
+
+		area, ok := areas[name]
+		if !ok {
+			area = &geoArea{bounds: emptyBounds()}
+			areas[name] = area
+		}
+
+		if err := area.addGeometry(*feature.Geometry); err != nil {
+			return nil, fmt.Errorf("area %s: %v", name, err)
+		}
+	}
+
+	return areas, nil
+}
+
+func filterByArea(entries []record, area *geoArea) []record {
+	var filtered []record
+	for _, entry := range entries {
+		if area.contains(entry.Geo) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered
+}
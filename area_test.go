@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"testing"
+)
+
+func TestGeoRingContains(t *testing.T) {
+	// An L-shaped ring, given as latitude and longitude pairs, whose notch
+	// covers latitudes and longitudes between 5 and 10.
+	ring := geoRing{{0, 0}, {0, 10}, {5, 10}, {5, 5}, {10, 5}, {10, 0}}
+
+	tests := []struct {
+		name  string
+		point geoData
+		want  bool
+	}{
+		{"inside", geoData{2, 2}, true},
+		{"inside arm", geoData{8, 2}, true},
+		{"inside other arm", geoData{2, 8}, true},
+		{"in notch", geoData{8, 8}, false},
+		{"outside", geoData{-1, 5}, false},
+		{"beyond longitude", geoData{2, 11}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ring.contains(test.point); got != test.want {
+				t.Errorf("contains(%v) = %v, want %v", test.point, got, test.want)
+			}
+		})
+	}
+}
+
+func TestGeoAreaContainsHoles(t *testing.T) {
+	area, err := parseArea([]byte(`{
+		"type": "MultiPolygon",
+		"coordinates": [
+			[
+				[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]],
+				[[4, 4], [6, 4], [6, 6], [4, 6], [4, 4]]
+			],
+			[
+				[[20, 20], [30, 20], [30, 30], [20, 30], [20, 20]]
+			]
+		]
+	}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		point geoData
+		want  bool
+	}{
+		{"inside outer ring", geoData{2, 2}, true},
+		{"between hole and edge", geoData{8, 5}, true},
+		{"inside hole", geoData{5, 5}, false},
+		{"inside second polygon", geoData{25, 25}, true},
+		{"between polygons", geoData{15, 15}, false},
+		{"outside bounds", geoData{-5, 5}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := area.contains(test.point); got != test.want {
+				t.Errorf("contains(%v) = %v, want %v", test.point, got, test.want)
+			}
+		})
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/binary"
+	"encoding/json"
 	"hash/fnv"
 )
 
@@ -166,18 +167,53 @@ func dumpData(dbPath string, restaraunts map[uint32]*restaurant) error {
 		}
 	}
 
+	_, err = db.Exec(`
+		DROP TABLE IF EXISTS sources;
+		CREATE TABLE sources(
+			reviewId INTEGER NOT NULL,
+			url VARCHAR(400) NOT NULL,
+			count INTEGER NOT NULL,
+			features TEXT NOT NULL,
+			FOREIGN KEY(reviewId) REFERENCES reviews(id) ON DELETE CASCADE)`)
+
+	if err != nil {
+		return err
+	}
+
+	for _, rest := range restaraunts {
+		for _, rev := range rest.reviews {
+			features, err := json.Marshal(rev.features)
+			if err != nil {
+				return err
+			}
+
+			if _, err := db.Exec("INSERT INTO sources(reviewId, url, count, features) VALUES(?, ?, ?, ?)", rest.id, rev.url, rev.count, string(features)); err != nil {
+				return err
+			}
+		}
+	}
+
 	_, err = db.Exec(`
 		DROP TABLE IF EXISTS categories;
 		CREATE TABLE categories(
 			description VARCHAR(200) NOT NULL,
+			userId VARCHAR(100) NOT NULL DEFAULT '',
+			displayOrder INTEGER NOT NULL DEFAULT 0,
+			section VARCHAR(100) NOT NULL DEFAULT '',
+			archived INTEGER NOT NULL DEFAULT 0,
+			type VARCHAR(20) NOT NULL DEFAULT 'scale',
+			options TEXT NOT NULL DEFAULT '[]',
+			minValue FLOAT NOT NULL DEFAULT -1,
+			maxValue FLOAT NOT NULL DEFAULT 1,
+			shared INTEGER NOT NULL DEFAULT 0,
 			id INTEGER PRIMARY KEY)`)
 
 	if err != nil {
 		return err
 	}
 
-	for _, category := range []string{"I prefer quiet places", "I enjoy Mexican Food", "I drive a car"} {
-		if _, err := db.Exec("INSERT INTO categories(description) VALUES (?)", category); err != nil {
+	for i, category := range []string{"I prefer quiet places", "I enjoy Mexican Food", "I drive a car"} {
+		if _, err := db.Exec("INSERT INTO categories(description, displayOrder, shared) VALUES (?, ?, 1)", category, i); err != nil {
 			return err
 		}
 	}
@@ -187,6 +223,9 @@ func dumpData(dbPath string, restaraunts map[uint32]*restaurant) error {
 		CREATE TABLE history(
 			date DATETIME NOT NULL,
 			reviewId INTEGER NOT NULL,
+			userId VARCHAR(100) NOT NULL DEFAULT '',
+			event VARCHAR(20) NOT NULL DEFAULT 'access',
+			eventValue FLOAT NOT NULL DEFAULT 0,
 			id INTEGER PRIMARY KEY,
 			FOREIGN KEY(reviewId) REFERENCES reviews(id))`)
 
@@ -200,8 +239,41 @@ func dumpData(dbPath string, restaraunts map[uint32]*restaurant) error {
 			categoryId INTEGER NOT NULL,
 			categoryValue FLOAT NOT NULL,
 			historyId INTEGER NOT NULL,
-			FOREIGN KEY(historyId) REFERENCES history(id),
-			FOREIGN KEY(categoryId) REFERENCES categories(id))`)
+			FOREIGN KEY(historyId) REFERENCES history(id) ON DELETE CASCADE,
+			FOREIGN KEY(categoryId) REFERENCES categories(id) ON DELETE CASCADE)`)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		DROP TABLE IF EXISTS cfNeighbors;
+		CREATE TABLE cfNeighbors(
+			reviewId INTEGER NOT NULL,
+			neighborId INTEGER NOT NULL,
+			similarity FLOAT NOT NULL,
+			builtAt DATETIME NOT NULL,
+			FOREIGN KEY(reviewId) REFERENCES reviews(id),
+			FOREIGN KEY(neighborId) REFERENCES reviews(id))`)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		DROP TABLE IF EXISTS profileValues;
+		DROP TABLE IF EXISTS profiles;
+		CREATE TABLE profiles(
+			name VARCHAR(200) NOT NULL,
+			userId VARCHAR(100) NOT NULL DEFAULT '',
+			updated DATETIME NOT NULL,
+			id INTEGER PRIMARY KEY);
+		CREATE TABLE profileValues(
+			profileId INTEGER NOT NULL,
+			categoryId INTEGER NOT NULL,
+			value FLOAT NOT NULL,
+			FOREIGN KEY(profileId) REFERENCES profiles(id) ON DELETE CASCADE,
+			FOREIGN KEY(categoryId) REFERENCES categories(id) ON DELETE CASCADE)`)
 
 	if err != nil {
 		return err
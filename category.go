@@ -0,0 +1,576 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type addCategoryRequest struct {
+	Description string   `json:"description"`
+	Options     []string `json:"options"`
+	Order       int      `json:"order"`
+	Range       *bracket `json:"range"`
+	Section     string   `json:"section"`
+	Type        string   `json:"type"`
+}
+
+type addCategoryResponse struct {
+	Description string   `json:"description"`
+	Id          int      `json:"id"`
+	Options     []string `json:"options,omitempty"`
+	Range       bracket  `json:"range"`
+	Success     bool     `json:"success"`
+	Type        string   `json:"type"`
+}
+
+type updateCategoryRequest struct {
+	Archived    *bool   `json:"archived"`
+	Description *string `json:"description"`
+	Id          int     `json:"id"`
+	Order       *int    `json:"order"`
+	Section     *string `json:"section"`
+}
+
+type reorderCategoriesRequest struct {
+	Ids []int `json:"ids"`
+}
+
+type removeCategoryRequest struct {
+	Archive bool `json:"archive"`
+	Id      int  `json:"id"`
+}
+
+func newCategorySpec(kind string, options []string, bounds *bracket) (categorySpec, error) {
+	t, err := parseCategoryType(kind)
+	if err != nil {
+		return categorySpec{}, err
+	}
+
+	spec := categorySpec{kind: t, bounds: bracket{-1, 1}}
+
+	switch t {
+	case categoryTypeScale:
+		if bounds != nil {
+			if bounds.Min >= bounds.Max {
+				return categorySpec{}, errors.New("invalid category range")
+			}
+
+			spec.bounds = *bounds
+		}
+	case categoryTypeBoolean:
+		spec.bounds = bracket{0, 1}
+	case categoryTypeChoice:
+		for _, option := range options {
+			if option = strings.TrimSpace(option); len(option) > 0 {
+				spec.options = append(spec.options, option)
+			}
+		}
+
+		if len(spec.options) < 2 {
+			return categorySpec{}, errors.New("choice categories require at least two options")
+		}
+
+		spec.bounds = bracket{0, float64(len(spec.options) - 1)}
+	}
+
+	return spec, nil
+}
+
+func scanCategorySpec(kind, options string, minValue, maxValue float64) (categorySpec, error) {
+	t, err := parseCategoryType(kind)
+	if err != nil {
+		return categorySpec{}, err
+	}
+
+	spec := categorySpec{kind: t, bounds: bracket{minValue, maxValue}}
+	if err := json.Unmarshal([]byte(options), &spec.options); err != nil {
+		return categorySpec{}, err
+	}
+
+	return spec, nil
+}
+
+// loadCategorySpecs returns the specs of the shared categories and those owned
+// by user, keyed by category id; other users' categories are left out so that
+// values can never be recorded against them.
+func loadCategorySpecs(db *sql.DB, user string) (map[string]categorySpec, error) {
+	rows, err := db.Query("SELECT id, type, options, minValue, maxValue FROM categories WHERE shared = 1 OR userId = (?)", user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	specs := make(map[string]categorySpec)
+	for rows.Next() {
+		var (
+			id                 int
+			kind, options      string
+			minValue, maxValue float64
+		)
+
+		if err := rows.Scan(&id, &kind, &options, &minValue, &maxValue); err != nil {
+			return nil, err
+		}
+
+		spec, err := scanCategorySpec(kind, options, minValue, maxValue)
+		if err != nil {
+			return nil, err
+		}
+
+		specs[strconv.Itoa(id)] = spec
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return specs, nil
+}
+
+func (s categorySpec) validate(value float64) error {
+	if math.IsNaN(value) || value < s.bounds.Min || value > s.bounds.Max {
+		return fmt.Errorf("value %v out of range [%v, %v]", value, s.bounds.Min, s.bounds.Max)
+	}
+
+	if s.kind != categoryTypeScale && value != math.Trunc(value) {
+		return fmt.Errorf("value %v is not a valid %s option", value, s.kind)
+	}
+
+	return nil
+}
+
+func (s categorySpec) normalize(value float64) float64 {
+	return 2*(value-s.bounds.Min)/(s.bounds.Max-s.bounds.Min) - 1
+}
+
+func (s categorySpec) similarity(value1, value2 float64) float64 {
+	switch s.kind {
+	case categoryTypeBoolean:
+		if value1 == value2 {
+			return 1
+		}
+		return -1
+	case categoryTypeChoice:
+		if value1 == value2 {
+			return 1
+		}
+		return 0
+	default:
+		return s.normalize(value1) * s.normalize(value2)
+	}
+}
+
+func validateProfile(specs map[string]categorySpec, profile map[string]float64) error {
+	for id, value := range profile {
+		spec, ok := specs[id]
+		if !ok {
+			continue
+		}
+
+		if err := spec.validate(value); err != nil {
+			return fmt.Errorf("category %s: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+func fetchCategories(db *sql.DB, user string, includeArchived bool) ([]category, error) {
+	query := "SELECT description, id, displayOrder, section, archived, shared, type, options, minValue, maxValue FROM categories WHERE (shared = 1 OR userId = (?))"
+	if !includeArchived {
+		query += " AND archived = 0"
+	}
+	query += " ORDER BY section, displayOrder, id"
+
+	rows, err := db.Query(query, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []category
+	for rows.Next() {
+		var (
+			cat                category
+			kind, options      string
+			minValue, maxValue float64
+		)
+
+		if err := rows.Scan(&cat.Description, &cat.Id, &cat.Order, &cat.Section, &cat.Archived, &cat.Shared, &kind, &options, &minValue, &maxValue); err != nil {
+			return nil, err
+		}
+
+		spec, err := scanCategorySpec(kind, options, minValue, maxValue)
+		if err != nil {
+			return nil, err
+		}
+
+		cat.Options = spec.options
+		cat.Range = spec.bounds
+		cat.Type = spec.kind.String()
+
+		categories = append(categories, cat)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return categories, nil
+}
+
+func deleteCategory(db *sql.DB, user string, id int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow("SELECT EXISTS(SELECT NULL FROM categories WHERE id = (?) AND userId = (?) AND shared = 0)", id, user).Scan(&exists); err != nil {
+		return false, err
+	}
+
+	if exists == 0 {
+		return false, nil
+	}
+
+	if _, err := tx.Exec("DELETE FROM historyGroups WHERE categoryId = (?)", id); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM categories WHERE id = (?)", id); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func handleGetCategories(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var archived bool
+	if value := req.URL.Query().Get("archived"); len(value) > 0 {
+		if archived, err = strconv.ParseBool(value); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	response, err := fetchCategories(db, requestUser(req), archived)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleAddCategory(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		request  addCategoryRequest
+		response addCategoryResponse
+	)
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	spec, err := newCategorySpec(request.Type, request.Options, request.Range)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	options, err := json.Marshal(spec.options)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Description = strings.TrimSpace(request.Description)
+	response.Options = spec.options
+	response.Range = spec.bounds
+	response.Type = spec.kind.String()
+
+	if len(response.Description) > 0 {
+		result, err := db.Exec(
+			"INSERT INTO categories(description, displayOrder, section, userId, type, options, minValue, maxValue) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+			request.Description,
+			request.Order,
+			strings.TrimSpace(request.Section),
+			requestUser(req),
+			spec.kind.String(),
+			string(options),
+			spec.bounds.Min,
+			spec.bounds.Max,
+		)
+
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		insertId, err := result.LastInsertId()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response.Success = rows > 0
+		response.Id = int(insertId)
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleUpdateCategory(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		request  updateCategoryRequest
+		response successResponse
+	)
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		columns []string
+		args    []interface{}
+	)
+
+	if request.Description != nil {
+		description := strings.TrimSpace(*request.Description)
+		if len(description) == 0 {
+			http.Error(rw, "invalid description", http.StatusInternalServerError)
+			return
+		}
+
+		columns = append(columns, "description = (?)")
+		args = append(args, description)
+	}
+
+	if request.Order != nil {
+		columns = append(columns, "displayOrder = (?)")
+		args = append(args, *request.Order)
+	}
+
+	if request.Section != nil {
+		columns = append(columns, "section = (?)")
+		args = append(args, strings.TrimSpace(*request.Section))
+	}
+
+	if request.Archived != nil {
+		columns = append(columns, "archived = (?)")
+		args = append(args, *request.Archived)
+	}
+
+	if len(columns) > 0 {
+		args = append(args, request.Id, requestUser(req))
+
+		result, err := db.Exec("UPDATE categories SET "+strings.Join(columns, ", ")+" WHERE id = (?) AND userId = (?) AND shared = 0", args...)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response.Success = rows > 0
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleReorderCategories(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		request  reorderCategoriesRequest
+		response successResponse
+	)
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	user := requestUser(req)
+	for order, id := range request.Ids {
+		if _, err := tx.Exec("UPDATE categories SET displayOrder = (?) WHERE id = (?) AND userId = (?) AND shared = 0", order, id, user); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Success = true
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleRemoveCategory(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		request  removeCategoryRequest
+		response successResponse
+	)
+
+	if isVersionedDelete(req) {
+		if request.Id, err = pathId(req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if archive := req.URL.Query().Get("archive"); len(archive) > 0 {
+			if request.Archive, err = strconv.ParseBool(archive); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	} else if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := requestUser(req)
+
+	if request.Archive {
+		result, err := db.Exec("UPDATE categories SET archived = 1 WHERE id = (?) AND userId = (?) AND shared = 0", request.Id, user)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response.Success = rows > 0
+	} else {
+		if response.Success, err = deleteCategory(db, user, request.Id); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
@@ -0,0 +1,416 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cfMaxNeighbors        = 50
+	defaultRecommendLimit = 10
+	maxRecommendLimit     = 100
+)
+
+type cfNeighbor struct {
+	id         int
+	similarity float64
+}
+
+type cfModel struct {
+	neighbors map[int][]cfNeighbor
+	builtAt   time.Time
+}
+
+type cfStats struct {
+	BuiltAt   time.Time `json:"builtAt"`
+	Items     int       `json:"items"`
+	Neighbors int       `json:"neighbors"`
+}
+
+var cf struct {
+	model *cfModel
+	mutex sync.RWMutex
+}
+
+func currentCFModel() *cfModel {
+	cf.mutex.RLock()
+	defer cf.mutex.RUnlock()
+	return cf.model
+}
+
+func setCFModel(model *cfModel) {
+	cf.mutex.Lock()
+	defer cf.mutex.Unlock()
+	cf.model = model
+}
+
+func (m *cfModel) stats() cfStats {
+	stats := cfStats{BuiltAt: m.builtAt, Items: len(m.neighbors)}
+	for _, neighbors := range m.neighbors {
+		stats.Neighbors += len(neighbors)
+	}
+
+	return stats
+}
+
+// predict estimates how much a user with the given normalized ratings would
+// like each item that neighbors one of the rated items, on a scale of -1 to 1.
+func (m *cfModel) predict(ratings map[int]float64) map[int]float64 {
+	var (
+		numerators   = make(map[int]float64)
+		denominators = make(map[int]float64)
+	)
+
+	for id, rating := range ratings {
+		for _, neighbor := range m.neighbors[id] {
+			numerators[neighbor.id] += rating * neighbor.similarity
+			denominators[neighbor.id] += math.Abs(neighbor.similarity)
+		}
+	}
+
+	predictions := make(map[int]float64)
+	for id, numerator := range numerators {
+		if denominator := denominators[id]; denominator > 0 {
+			predictions[id] = numerator / denominator
+		}
+	}
+
+	return predictions
+}
+
+// loadRatings collects per-user item ratings from history, summing event
+// weights and scaling each user's ratings into the range -1 to 1.
+func loadRatings(ctx context.Context, db *sql.DB, where string, args ...interface{}) (map[string]map[int]float64, error) {
+	start := time.Now()
+
+	rows, err := db.QueryContext(ctx, "SELECT userId, reviewId, event, eventValue FROM history WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := make(map[string]map[int]float64)
+	for rows.Next() {
+		var (
+			user, event string
+			reviewId    int
+			eventValue  float64
+		)
+
+		if err := rows.Scan(&user, &reviewId, &event, &eventValue); err != nil {
+			return nil, err
+		}
+
+		userRatings, ok := ratings[user]
+		if !ok {
+			userRatings = make(map[int]float64)
+			ratings[user] = userRatings
+		}
+
+		userRatings[reviewId] += eventWeight(event, eventValue, nil)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	observeDB(ctx, "ratings", start)
+
+	for _, userRatings := range ratings {
+		normalizeRatings(userRatings)
+	}
+
+	return ratings, nil
+}
+
+// normalizeRatings scales ratings in place into the range -1 to 1.
+func normalizeRatings(ratings map[int]float64) {
+	var maxRating float64
+	for _, rating := range ratings {
+		maxRating = math.Max(maxRating, math.Abs(rating))
+	}
+
+	if maxRating > 0 {
+		for id := range ratings {
+			ratings[id] /= maxRating
+		}
+	}
+}
+
+type cfPair struct {
+	first, second int
+}
+
+// cfBuilder accumulates the item similarity terms contributed by each user,
+// so that a user's ratings can be replaced without revisiting everyone else.
+type cfBuilder struct {
+	ratings  map[string]map[int]float64
+	products map[cfPair]float64
+	norms    map[int]float64
+}
+
+func newCFBuilder() *cfBuilder {
+	return &cfBuilder{
+		ratings:  make(map[string]map[int]float64),
+		products: make(map[cfPair]float64),
+		norms:    make(map[int]float64),
+	}
+}
+
+func (b *cfBuilder) accumulate(userRatings map[int]float64, sign float64) {
+	ids := make([]int, 0, len(userRatings))
+	for id, rating := range userRatings {
+		b.norms[id] += sign * rating * rating
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+
+	for i, first := range ids {
+		for _, second := range ids[i+1:] {
+			b.products[cfPair{first, second}] += sign * userRatings[first] * userRatings[second]
+		}
+	}
+}
+
+// setUser replaces the normalized ratings of a user.
+func (b *cfBuilder) setUser(user string, userRatings map[int]float64) {
+	if previous, ok := b.ratings[user]; ok {
+		b.accumulate(previous, -1)
+	}
+
+	b.ratings[user] = userRatings
+	b.accumulate(userRatings, 1)
+}
+
+func (b *cfBuilder) model() *cfModel {
+	// Terms removed by setUser and the order users were added in leave
+	// rounding residue behind, so similarities are rounded to keep ties and
+	// the neighbor order stable.
+	const epsilon = 1e-9
+
+	model := &cfModel{neighbors: make(map[int][]cfNeighbor), builtAt: time.Now()}
+	for pair, product := range b.products {
+		norm := math.Sqrt(b.norms[pair.first] * b.norms[pair.second])
+		if norm < epsilon || product < epsilon {
+			continue
+		}
+
+		similarity := math.Round(product/norm/epsilon) * epsilon
+		model.neighbors[pair.first] = append(model.neighbors[pair.first], cfNeighbor{pair.second, similarity})
+		model.neighbors[pair.second] = append(model.neighbors[pair.second], cfNeighbor{pair.first, similarity})
+	}
+
+	for id, neighbors := range model.neighbors {
+		sort.Slice(neighbors, func(i, j int) bool {
+			if neighbors[i].similarity == neighbors[j].similarity {
+				return neighbors[i].id < neighbors[j].id
+			}
+
+			return neighbors[i].similarity > neighbors[j].similarity
+		})
+
+		if len(neighbors) > cfMaxNeighbors {
+			model.neighbors[id] = neighbors[:cfMaxNeighbors]
+		}
+	}
+
+	return model
+}
+
+// buildCFModel computes item similarities from the history entries with ids
+// below before.
+func buildCFModel(db *sql.DB, before int64) (*cfModel, error) {
+	ratings, err := loadRatings(context.Background(), db, "userId != '' AND userId != (?) AND id < (?)", legacyUser, before)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := newCFBuilder()
+	for user, userRatings := range ratings {
+		builder.setUser(user, userRatings)
+	}
+
+	return builder.model(), nil
+}
+
+func saveCFModel(db *sql.DB, model *cfModel) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM cfNeighbors"); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO cfNeighbors(reviewId, neighborId, similarity, builtAt) VALUES(?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for id, neighbors := range model.neighbors {
+		for _, neighbor := range neighbors {
+			if _, err := stmt.Exec(id, neighbor.id, neighbor.similarity, model.builtAt.UTC()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func loadCFModel(db *sql.DB) (*cfModel, error) {
+	rows, err := db.Query("SELECT reviewId, neighborId, similarity, builtAt FROM cfNeighbors ORDER BY reviewId, similarity DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	model := &cfModel{neighbors: make(map[int][]cfNeighbor)}
+	for rows.Next() {
+		var (
+			id, neighborId int
+			similarity     float64
+			builtAt        time.Time
+		)
+
+		if err := rows.Scan(&id, &neighborId, &similarity, &builtAt); err != nil {
+			return nil, err
+		}
+
+		model.neighbors[id] = append(model.neighbors[id], cfNeighbor{neighborId, similarity})
+		model.builtAt = builtAt
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return model, nil
+}
+
+func computeRecordCF(db *sql.DB, entries []record, qc queryContext) error {
+	model := qc.cf
+	if model == nil || qc.cfWeight == 0 {
+		return nil
+	}
+
+	ratings, err := loadRatings(qc.ctx, db, "userId = (?) AND id < (?)", qc.user, qc.historyCutoff())
+	if err != nil {
+		return err
+	}
+
+	predictions := model.predict(ratings[qc.user])
+	for i := range entries {
+		entry := &entries[i]
+
+		entry.Cf = predictions[entry.Id]
+		entry.bias += qc.cfWeight * entry.Cf
+	}
+
+	return nil
+}
+
+func recommendRecords(ctx context.Context, db *sql.DB, user string, limit int) ([]recommendation, error) {
+	model := currentCFModel()
+	if model == nil {
+		return nil, nil
+	}
+
+	ratings, err := loadRatings(ctx, db, "userId = (?)", user)
+	if err != nil {
+		return nil, err
+	}
+
+	userRatings := ratings[user]
+
+	var recommendations []recommendation
+	for id, score := range model.predict(userRatings) {
+		if _, rated := userRatings[id]; rated || score <= 0 {
+			continue
+		}
+
+		recommendations = append(recommendations, recommendation{Id: id, Score: score})
+	}
+
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Score == recommendations[j].Score {
+			return recommendations[i].Id < recommendations[j].Id
+		}
+
+		return recommendations[i].Score > recommendations[j].Score
+	})
+
+	if len(recommendations) > limit {
+		recommendations = recommendations[:limit]
+	}
+
+	if len(recommendations) == 0 {
+		return recommendations, nil
+	}
+
+	var (
+		ids     []interface{}
+		indices = make(map[int]int)
+	)
+
+	for i, rec := range recommendations {
+		ids = append(ids, rec.Id)
+		indices[rec.Id] = i
+	}
+
+	rows, err := db.Query("SELECT id, name, address, latitude, longitude FROM reviews WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id            int
+			name, address string
+			geo           geoData
+		)
+
+		if err := rows.Scan(&id, &name, &address, &geo.Latitude, &geo.Longitude); err != nil {
+			return nil, err
+		}
+
+		rec := &recommendations[indices[id]]
+		rec.Name = name
+		rec.Address = address
+		rec.Geo = geo
+	}
+
+	return recommendations, rows.Err()
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"math"
+	"sort"
+)
+
+const clusterCellsPerTile = 4
+
+type clusterBounds struct {
+	North float64 `json:"north"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	West  float64 `json:"west"`
+}
+
+type cluster struct {
+	Centroid  geoData `json:"centroid"`
+	Count     int     `json:"count"`
+	MeanScore float64 `json:"meanScore"`
+	TopRecord record  `json:"topRecord"`
+}
+
+type clusterRequest struct {
+	queryRequest
+	Bounds *clusterBounds `json:"bounds"`
+	Zoom   int            `json:"zoom"`
+}
+
+type clusterResponse struct {
+	Clusters    []cluster `json:"clusters"`
+	Count       int       `json:"count"`
+	ElapsedTime int64     `json:"elapsedTime"`
+}
+
+type clusterCell struct {
+	row, col int
+}
+
+func (b clusterBounds) contains(point geoData) bool {
+	return point.Latitude >= b.South && point.Latitude <= b.North && point.Longitude >= b.West && point.Longitude <= b.East
+}
+
+func clusterRecords(entries []record, bounds *clusterBounds, zoom int) []cluster {
+	zoom = int(math.Max(0, math.Min(float64(zoom), 21)))
+	cellSize := 360.0 / math.Pow(2, float64(zoom)) / clusterCellsPerTile
+
+	var (
+		cells    = make(map[clusterCell]*cluster)
+		clusters []*cluster
+	)
+
+	for _, entry := range entries {
+		if bounds != nil && !bounds.contains(entry.Geo) {
+			continue
+		}
+
+		cell := clusterCell{
+			row: int(math.Floor(entry.Geo.Latitude / cellSize)),
+			col: int(math.Floor(entry.Geo.Longitude / cellSize)),
+		}
+
+		c, ok := cells[cell]
+		if !ok {
+			c = &cluster{TopRecord: entry}
+			cells[cell] = c
+			clusters = append(clusters, c)
+		}
+
+		c.Centroid.Latitude += entry.Geo.Latitude
+		c.Centroid.Longitude += entry.Geo.Longitude
+		c.MeanScore += entry.Score
+		c.Count++
+
+		if entry.Score > c.TopRecord.Score {
+			c.TopRecord = entry
+		}
+	}
+
+	results := make([]cluster, 0, len(clusters))
+	for _, c := range clusters {
+		count := float64(c.Count)
+
+		c.Centroid.Latitude /= count
+		c.Centroid.Longitude /= count
+		c.MeanScore /= count
+
+		results = append(results, *c)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Count > results[j].Count
+	})
+
+	return results
+}
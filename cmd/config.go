@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type jsonValue struct {
+	target interface{}
+}
+
+func (v jsonValue) String() string {
+	if v.target == nil {
+		return ""
+	}
+
+	data, _ := json.Marshal(v.target)
+	return string(data)
+}
+
+func (v jsonValue) Set(value string) error {
+	return json.Unmarshal([]byte(value), v.target)
+}
+
+func envName(name string) string {
+	return "SEARCH_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadSettings reads a JSON config file mapping flag names to values; string
+// values are used as-is and anything else is passed to the flag as raw JSON.
+func loadSettings(filename string) (map[string]string, error) {
+	settings := make(map[string]string)
+	if len(filename) == 0 {
+		return settings, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	for name, value := range values {
+		var str string
+		if err := json.Unmarshal(value, &str); err == nil {
+			settings[name] = str
+		} else {
+			settings[name] = string(value)
+		}
+	}
+
+	return settings, nil
+}
+
+// applySettings fills in flags that were not given on the command line, first
+// from SEARCH_* environment variables and then from the config file.
+func applySettings(fs *flag.FlagSet, settings map[string]string) error {
+	for name := range settings {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || err != nil {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			value, ok = settings[f.Name]
+		}
+
+		if ok {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("%s: %v", f.Name, e)
+			}
+		}
+	})
+
+	return err
+}
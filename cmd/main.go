@@ -23,28 +23,76 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"syscall"
+	"time"
 
-	"github.com/FooSoft/search"
+	"foosoft.net/projects/restaurant-search"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
 	var (
-		portNum = flag.Int("port", 8080, "port to serve content on")
-		profile = flag.String("profile", "", "write cpu profile to file")
+		options search.Options
+
+		configPath     = flag.String("config", "", "JSON file of flag values (env: SEARCH_CONFIG)")
+		portNum        = flag.Int("port", 0, "port to serve content on (overrides -listen)")
+		profile        = flag.String("profile", "", "write cpu profile to file")
+		retentionAge   = flag.Duration("retention-age", 0, "maximum age of access history (0 keeps all)")
+		retentionRows  = flag.Int("retention-rows", 0, "maximum access history entries per user (0 keeps all)")
+		retentionCheck = flag.Duration("retention-interval", time.Hour, "interval between history retention checks")
+		readTimeout    = flag.Duration("read-timeout", 10*time.Second, "maximum duration for reading a request")
+		writeTimeout   = flag.Duration("write-timeout", 30*time.Second, "maximum duration for writing a response")
+		idleTimeout    = flag.Duration("idle-timeout", 2*time.Minute, "maximum time to keep idle connections open")
+		drainTimeout   = flag.Duration("shutdown-timeout", 15*time.Second, "time allowed for in-flight requests on shutdown")
 	)
 
+	flag.StringVar(&options.Addr, "listen", ":8080", "address to serve content on")
+	flag.StringVar(&options.DataPath, "db", "../build/data/db.sqlite3", "restaurant database")
+	flag.StringVar(&options.StaticPath, "static", "", "serve the web UI from this directory instead of the embedded copy")
+	flag.StringVar(&options.AreasPath, "areas", "", "named area GeoJSON file (defaults next to the database)")
+	flag.StringVar(&options.StationsPath, "stations", "", "station coordinate file (defaults next to the database)")
+	flag.Var(jsonValue{&options.Features}, "features", "default feature values as a JSON object")
+	flag.Var(jsonValue{&options.Modes}, "modes", "default feature modes as a JSON object")
+	flag.StringVar(&options.LogLevel, "log-level", "info", "minimum log level: debug, info, warn or error")
+	flag.StringVar(&options.LogFormat, "log-format", "text", "log output format: text or json")
+	flag.StringVar(&options.AdminToken, "admin-token", "", "bearer token required by /admin endpoints, which are disabled when empty")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Each flag may also be set with a SEARCH_<NAME> environment variable or in the -config file.")
+		flag.PrintDefaults()
+	}
+
 	flag.Parse()
 
+	if len(*configPath) == 0 {
+		*configPath = os.Getenv(envName("config"))
+	}
+
+	settings, err := loadSettings(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := applySettings(flag.CommandLine, settings); err != nil {
+		log.Fatal(err)
+	}
+
+	if *portNum != 0 {
+		options.Addr = fmt.Sprintf(":%d", *portNum)
+	}
+
 	if *profile != "" {
 		f, err := os.Create(*profile)
 		if err != nil {
@@ -52,21 +100,86 @@ func main() {
 		}
 
 		pprof.StartCPUProfile(f)
+	}
 
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	handler, err := search.NewSearchApp(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stopRetention, err := search.StartRetention(search.RetentionPolicy{
+		DataPath: options.DataPath,
+		Interval: *retentionCheck,
+		MaxAge:   *retentionAge,
+		MaxRows:  *retentionRows,
+	})
 
-		go func() {
-			<-c
-			pprof.StopCPUProfile()
-			os.Exit(1)
-		}()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &http.Server{
+		Addr:              options.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: *readTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+
+	err = serve(server, *drainTimeout)
+
+	stopRetention()
+	if *profile != "" {
+		pprof.StopCPUProfile()
 	}
 
-	mux, err := search.NewSearchApp()
 	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+// serve runs server until it fails or the process receives SIGINT or SIGTERM,
+// then waits up to timeout for in-flight requests before cancelling them.
+func serve(server *http.Server, timeout time.Duration) error {
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
+	server.BaseContext = func(net.Listener) context.Context {
+		return baseCtx
+	}
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Printf("serving on %s", server.Addr)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-signalCtx.Done():
+	}
+
+	stop()
+	log.Print("shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		cancelBase()
+		server.Close()
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+
+		log.Print("shutdown timed out; in-flight requests cancelled")
+	}
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *portNum), mux))
+	return nil
 }
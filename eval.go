@@ -0,0 +1,370 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// EvalCase is a single ranking judgment: the user and profile a query is
+// issued with, and the graded relevance of restaurants keyed by review id.
+type EvalCase struct {
+	Judgments map[int]float64    `json:"judgments"`
+	Profile   map[string]float64 `json:"profile"`
+	User      string             `json:"user"`
+	before    int
+}
+
+// EvalReport holds ranking metrics averaged over all evaluated cases.
+type EvalReport struct {
+	Cases  int     `json:"cases"`
+	K      int     `json:"k"`
+	MRR    float64 `json:"mrr"`
+	NDCG   float64 `json:"ndcg"`
+	Recall float64 `json:"recall"`
+}
+
+// LoadJudgments reads relevance judgments from a JSON file holding an array
+// of cases.
+func LoadJudgments(filename string) ([]EvalCase, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cases []EvalCase
+	if err := json.NewDecoder(file).Decode(&cases); err != nil {
+		return nil, err
+	}
+
+	return cases, nil
+}
+
+// openEvalDatabase opens the database at dbPath and brings its schema up to
+// date the same way the server does on startup.
+func openEvalDatabase(dbPath string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := upgradeSchema(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("upgrading schema of %s: %v", dbPath, err)
+	}
+
+	return db, nil
+}
+
+// LoadHistoryCases turns every positive history event into a case that
+// expects the accessed restaurant, issued with the profile snapshot recorded
+// alongside it. Each case only sees the history logged before the event.
+func LoadHistoryCases(dbPath string) ([]EvalCase, error) {
+	db, err := openEvalDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT history.id, history.userId, history.reviewId, history.event, history.eventValue, historyGroups.categoryId, historyGroups.categoryValue
+		FROM history LEFT JOIN historyGroups ON historyGroups.historyId = history.id
+		ORDER BY history.id`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		cases   []EvalCase
+		indices = make(map[int]int)
+	)
+
+	for rows.Next() {
+		var (
+			historyId, reviewId int
+			user, event         string
+			eventValue          float64
+			categoryId          sql.NullInt64
+			categoryValue       sql.NullFloat64
+		)
+
+		if err := rows.Scan(&historyId, &user, &reviewId, &event, &eventValue, &categoryId, &categoryValue); err != nil {
+			return nil, err
+		}
+
+		weight := eventWeight(event, eventValue, nil)
+		if weight <= 0 {
+			continue
+		}
+
+		index, ok := indices[historyId]
+		if !ok {
+			index = len(cases)
+			indices[historyId] = index
+			cases = append(cases, EvalCase{
+				Judgments: map[int]float64{reviewId: weight},
+				Profile:   make(map[string]float64),
+				User:      user,
+				before:    historyId,
+			})
+		}
+
+		if categoryId.Valid {
+			cases[index].Profile[strconv.FormatInt(categoryId.Int64, 10)] = categoryValue.Float64
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return cases, nil
+}
+
+type cfReplayEntry struct {
+	id       int
+	user     string
+	reviewId int
+	weight   float64
+}
+
+// cfReplay produces the collaborative filtering models for replayed cases by
+// feeding history into a cfBuilder in id order, so that each model only sees
+// the entries preceding its cutoff and history is read once.
+type cfReplay struct {
+	builder *cfBuilder
+	ratings map[string]map[int]float64
+	entries []cfReplayEntry
+	next    int
+	model   *cfModel
+}
+
+func loadCFReplay(db *sql.DB) (*cfReplay, error) {
+	rows, err := db.Query("SELECT id, userId, reviewId, event, eventValue FROM history WHERE userId != '' AND userId != (?) ORDER BY id", legacyUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replay := &cfReplay{builder: newCFBuilder(), ratings: make(map[string]map[int]float64)}
+	for rows.Next() {
+		var (
+			entry      cfReplayEntry
+			event      string
+			eventValue float64
+		)
+
+		if err := rows.Scan(&entry.id, &entry.user, &entry.reviewId, &event, &eventValue); err != nil {
+			return nil, err
+		}
+
+		entry.weight = eventWeight(event, eventValue, nil)
+		replay.entries = append(replay.entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return replay, nil
+}
+
+// modelBefore returns the model built from the entries with ids below
+// before; cutoffs must be requested in ascending order.
+func (r *cfReplay) modelBefore(before int) *cfModel {
+	changed := make(map[string]bool)
+	for ; r.next < len(r.entries) && r.entries[r.next].id < before; r.next++ {
+		entry := r.entries[r.next]
+
+		userRatings, ok := r.ratings[entry.user]
+		if !ok {
+			userRatings = make(map[int]float64)
+			r.ratings[entry.user] = userRatings
+		}
+
+		userRatings[entry.reviewId] += entry.weight
+		changed[entry.user] = true
+	}
+
+	for user := range changed {
+		normalized := make(map[int]float64, len(r.ratings[user]))
+		for id, rating := range r.ratings[user] {
+			normalized[id] = rating
+		}
+
+		normalizeRatings(normalized)
+		r.builder.setUser(user, normalized)
+	}
+
+	if r.model == nil || len(changed) > 0 {
+		r.model = r.builder.model()
+	}
+
+	return r.model
+}
+
+func rankingMetrics(ranking []record, judgments map[int]float64, k int) (ndcg, rr, recall float64) {
+	var (
+		dcg, idcg float64
+		grades    []float64
+		found     int
+	)
+
+	for _, grade := range judgments {
+		if grade > 0 {
+			grades = append(grades, grade)
+		}
+	}
+
+	if len(grades) == 0 {
+		return
+	}
+
+	for i, entry := range ranking {
+		grade := judgments[entry.Id]
+		if grade <= 0 {
+			continue
+		}
+
+		if rr == 0 {
+			rr = 1 / float64(i+1)
+		}
+
+		if i < k {
+			dcg += (math.Pow(2, grade) - 1) / math.Log2(float64(i+2))
+			found++
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.Float64Slice(grades)))
+	for i, grade := range grades {
+		if i >= k {
+			break
+		}
+
+		idcg += (math.Pow(2, grade) - 1) / math.Log2(float64(i+2))
+	}
+
+	if idcg > 0 {
+		ndcg = dcg / idcg
+	}
+	recall = float64(found) / float64(len(grades))
+	return
+}
+
+// EvaluateRanking replays the cases against the query scoring pipeline using
+// the given query configuration, which has the same JSON layout as a /query
+// request, and reports NDCG@k, MRR and recall@k.
+func EvaluateRanking(dbPath string, config []byte, cases []EvalCase, k int) (*EvalReport, error) {
+	if k <= 0 {
+		return nil, errors.New("cutoff rank must be positive")
+	}
+
+	var request queryRequest
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &request); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := openEvalDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var (
+		model  *cfModel
+		replay *cfReplay
+	)
+
+	if request.CfWeight != 0 {
+		if model, err = loadCFModel(db); err != nil {
+			return nil, err
+		}
+
+		if replay, err = loadCFReplay(db); err != nil {
+			return nil, err
+		}
+	}
+
+	// Cases are replayed in history order so that the model for each cutoff
+	// can be extended from the previous one.
+	order := make([]int, len(cases))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return cases[order[i]].before < cases[order[j]].before
+	})
+
+	report := &EvalReport{K: k}
+	for _, index := range order {
+		c := cases[index]
+
+		caseRequest := request
+		caseRequest.cfModel = model
+		caseRequest.historyBefore = c.before
+		if c.Profile != nil {
+			caseRequest.Profile = c.Profile
+		}
+
+		// Replayed cases get a model built only from the history preceding
+		// them, so that the event being predicted cannot leak into it.
+		if replay != nil && c.before > 0 {
+			caseRequest.cfModel = replay.modelBefore(c.before)
+		}
+
+		result, err := executeQuery(context.Background(), db, c.User, caseRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		ndcg, rr, recall := rankingMetrics(result.matchedEntries, c.Judgments, k)
+
+		report.NDCG += ndcg
+		report.MRR += rr
+		report.Recall += recall
+		report.Cases++
+	}
+
+	if report.Cases > 0 {
+		report.NDCG /= float64(report.Cases)
+		report.MRR /= float64(report.Cases)
+		report.Recall /= float64(report.Cases)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"foosoft.net/projects/restaurant-search"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func main() {
+	var (
+		dbPath        = flag.String("db", "../build/data/db.sqlite3", "database to evaluate against")
+		judgmentsPath = flag.String("judgments", "", "relevance judgment file (replays history if empty)")
+		k             = flag.Int("k", 10, "cutoff rank for NDCG and recall")
+	)
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [config.json ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *k <= 0 {
+		log.Fatal("cutoff rank must be positive")
+	}
+
+	var (
+		cases []search.EvalCase
+		err   error
+	)
+
+	if len(*judgmentsPath) > 0 {
+		log.Printf("loading judgments from %s...", *judgmentsPath)
+		cases, err = search.LoadJudgments(*judgmentsPath)
+	} else {
+		log.Printf("loading history from %s...", *dbPath)
+		cases, err = search.LoadHistoryCases(*dbPath)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	configs := flag.Args()
+	if len(configs) == 0 {
+		configs = []string{""}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "config\tcases\tndcg@%d\tmrr\trecall@%d\n", *k, *k)
+
+	for _, configPath := range configs {
+		var config []byte
+		if len(configPath) > 0 {
+			if config, err = os.ReadFile(configPath); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		log.Printf("evaluating %d cases with %s...", len(cases), configName(configPath))
+		report, err := search.EvaluateRanking(*dbPath, config, cases, *k)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%.4f\t%.4f\t%.4f\n", configName(configPath), report.Cases, report.NDCG, report.MRR, report.Recall)
+	}
+
+	w.Flush()
+}
+
+func configName(configPath string) string {
+	if len(configPath) == 0 {
+		return "default"
+	}
+
+	return configPath
+}
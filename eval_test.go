@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"math"
+	"testing"
+)
+
+func rankedRecords(ids ...int) []record {
+	ranking := make([]record, len(ids))
+	for i, id := range ids {
+		ranking[i].Id = id
+	}
+
+	return ranking
+}
+
+func TestRankingMetrics(t *testing.T) {
+	tests := []struct {
+		name      string
+		ranking   []record
+		judgments map[int]float64
+		k         int
+		ndcg      float64
+		rr        float64
+		recall    float64
+	}{
+		{"no judgments", rankedRecords(1, 2), nil, 10, 0, 0, 0},
+		{"empty ideal", rankedRecords(1, 2), map[int]float64{1: 0, 2: -1}, 10, 0, 0, 0},
+		{"empty ranking", nil, map[int]float64{1: 1}, 10, 0, 0, 0},
+		{"ideal order", rankedRecords(1, 2, 3), map[int]float64{1: 2, 2: 1}, 10, 1, 1, 1},
+		{"second rank", rankedRecords(5, 1), map[int]float64{1: 1}, 10, 1 / math.Log2(3), 0.5, 1},
+		{"reversed grades", rankedRecords(2, 1), map[int]float64{1: 2, 2: 1}, 10, (1 + 3/math.Log2(3)) / (3 + 1/math.Log2(3)), 1, 1},
+		{"beyond cutoff", rankedRecords(5, 6, 1), map[int]float64{1: 1}, 2, 0, 1.0 / 3, 0},
+		{"partial recall", rankedRecords(1, 5), map[int]float64{1: 1, 2: 1}, 10, 1 / (1 + 1/math.Log2(3)), 1, 0.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ndcg, rr, recall := rankingMetrics(test.ranking, test.judgments, test.k)
+
+			if !approxEqual(ndcg, test.ndcg) {
+				t.Errorf("ndcg = %v, want %v", ndcg, test.ndcg)
+			}
+
+			if !approxEqual(rr, test.rr) {
+				t.Errorf("reciprocal rank = %v, want %v", rr, test.rr)
+			}
+
+			if !approxEqual(recall, test.recall) {
+				t.Errorf("recall = %v, want %v", recall, test.recall)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+type exportFormat struct {
+	contentType string
+	extension   string
+	encode      func([]record) ([]byte, error)
+}
+
+const defaultExportFormat = "geojson"
+
+var exportFormats = map[string]exportFormat{
+	"geojson": {"application/geo+json", "geojson", exportGeoJSON},
+	"kml":     {"application/vnd.google-earth.kml+xml", "kml", exportKML},
+}
+
+type exportRequest struct {
+	queryRequest
+	Format string `json:"format"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPlacemark struct {
+	Name        string    `xml:"name"`
+	Description string    `xml:"description"`
+	Data        []kmlData `xml:"ExtendedData>Data"`
+	Coordinates string    `xml:"Point>coordinates"`
+}
+
+type kmlDocument struct {
+	XMLName    xml.Name       `xml:"kml"`
+	Namespace  string         `xml:"xmlns,attr"`
+	Name       string         `xml:"Document>name"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+func recordProperties(entry record) map[string]interface{} {
+	properties := map[string]interface{}{
+		"accessCount":    entry.AccessCount,
+		"address":        entry.Address,
+		"closestStn":     entry.ClosestStn,
+		"compatibility":  entry.Compatibility,
+		"distanceToStn":  entry.DistanceToStn,
+		"distanceToUser": entry.DistanceToUser,
+		"id":             entry.Id,
+		"name":           entry.Name,
+		"score":          entry.Score,
+	}
+
+	for name, value := range entry.features {
+		properties[name] = value
+	}
+
+	return properties
+}
+
+func exportGeoJSON(entries []record) ([]byte, error) {
+	type geometry struct {
+		Type        string     `json:"type"`
+		Coordinates [2]float64 `json:"coordinates"`
+	}
+
+	type feature struct {
+		Type       string                 `json:"type"`
+		Id         int                    `json:"id"`
+		Geometry   geometry               `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+
+	collection := struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+	}{Type: "FeatureCollection", Features: []feature{}}
+
+	for _, entry := range entries {
+		collection.Features = append(collection.Features, feature{
+			Type:       "Feature",
+			Id:         entry.Id,
+			Geometry:   geometry{"Point", [2]float64{entry.Geo.Longitude, entry.Geo.Latitude}},
+			Properties: recordProperties(entry),
+		})
+	}
+
+	return json.Marshal(collection)
+}
+
+func exportKML(entries []record) ([]byte, error) {
+	formatFloat := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	doc := kmlDocument{
+		Namespace: "http://www.opengis.net/kml/2.2",
+		Name:      "Restaurant search results",
+	}
+
+	for _, entry := range entries {
+		placemark := kmlPlacemark{
+			Name:        entry.Name,
+			Description: entry.Address,
+			Coordinates: fmt.Sprintf("%s,%s", formatFloat(entry.Geo.Longitude), formatFloat(entry.Geo.Latitude)),
+			Data: []kmlData{
+				{"id", strconv.Itoa(entry.Id)},
+				{"address", entry.Address},
+				{"score", formatFloat(entry.Score)},
+				{"compatibility", formatFloat(entry.Compatibility)},
+				{"accessCount", strconv.Itoa(entry.AccessCount)},
+				{"closestStn", entry.ClosestStn},
+				{"distanceToStn", formatFloat(entry.DistanceToStn)},
+				{"distanceToUser", formatFloat(entry.DistanceToUser)},
+			},
+		}
+
+		var names []string
+		for name := range entry.features {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			placemark.Data = append(placemark.Data, kmlData{name, formatFloat(entry.features[name])})
+		}
+
+		doc.Placemarks = append(doc.Placemarks, placemark)
+	}
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), data...), nil
+}
@@ -3,7 +3,6 @@ module foosoft.net/projects/restaurant-search
 go 1.18
 
 require (
-	github.com/FooSoft/search v0.0.0-20211216020216-022dc6c008c0
 	github.com/GaryBoone/GoStats v0.0.0-20130122001700-1993eafbef57
 	github.com/PuerkitoBio/goquery v1.8.0
 	github.com/fatih/color v1.13.0
@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type tableSchema struct {
+	name    string
+	columns map[string]string
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+type readinessCheck struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Ready  bool             `json:"ready"`
+	Checks []readinessCheck `json:"checks"`
+}
+
+const readinessTimeout = 5 * time.Second
+
+// requiredSchema lists the tables and declared column types that queries
+// depend on; additional columns are allowed.
+var requiredSchema = []tableSchema{
+	{"reviews", map[string]string{
+		"name":           "VARCHAR(100)",
+		"address":        "VARCHAR(400)",
+		"delicious":      "FLOAT",
+		"accommodating":  "FLOAT",
+		"affordable":     "FLOAT",
+		"atmospheric":    "FLOAT",
+		"latitude":       "FLOAT",
+		"longitude":      "FLOAT",
+		"closestStnDist": "FLOAT",
+		"closestStnName": "VARCHAR(100)",
+		"accessCount":    "INTEGER",
+		"id":             "INTEGER",
+	}},
+	{"categories", map[string]string{
+		"description":  "VARCHAR(200)",
+		"userId":       "VARCHAR(100)",
+		"displayOrder": "INTEGER",
+		"section":      "VARCHAR(100)",
+		"archived":     "INTEGER",
+		"type":         "VARCHAR(20)",
+		"options":      "TEXT",
+		"minValue":     "FLOAT",
+		"maxValue":     "FLOAT",
+		"shared":       "INTEGER",
+		"id":           "INTEGER",
+	}},
+	{"history", map[string]string{
+		"date":       "DATETIME",
+		"reviewId":   "INTEGER",
+		"userId":     "VARCHAR(100)",
+		"event":      "VARCHAR(20)",
+		"eventValue": "FLOAT",
+		"id":         "INTEGER",
+	}},
+	{"historyGroups", map[string]string{
+		"categoryId":    "INTEGER",
+		"categoryValue": "FLOAT",
+		"historyId":     "INTEGER",
+	}},
+}
+
+func newReadinessCheck(name string, problems []string) readinessCheck {
+	return readinessCheck{Name: name, Ok: len(problems) == 0, Error: strings.Join(problems, "; ")}
+}
+
+// problems describes how the columns found for table differ from what
+// it requires.
+func (t tableSchema) problems(columns map[string]string) []string {
+	if len(columns) == 0 {
+		return []string{"table does not exist"}
+	}
+
+	var names []string
+	for name := range t.columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		columnType, ok := columns[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("missing column %s", name))
+		case !strings.EqualFold(columnType, t.columns[name]):
+			problems = append(problems, fmt.Sprintf("column %s has type %s, expected %s", name, columnType, t.columns[name]))
+		}
+	}
+
+	return problems
+}
+
+// checkDatabase verifies that the database file exists and opens, followed
+// by one check per table in requiredSchema when it does.
+func checkDatabase(ctx context.Context) []readinessCheck {
+	// Opening a missing file would silently create an empty database.
+	if _, err := os.Stat(dataSrc); err != nil {
+		return []readinessCheck{newReadinessCheck("database", []string{err.Error()})}
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return []readinessCheck{newReadinessCheck("database", []string{err.Error()})}
+	}
+	defer db.Close()
+
+	if err := db.PingContext(ctx); err != nil {
+		return []readinessCheck{newReadinessCheck("database", []string{err.Error()})}
+	}
+
+	checks := []readinessCheck{newReadinessCheck("database", nil)}
+	for _, table := range requiredSchema {
+		var problems []string
+
+		columns, err := tableColumns(ctx, db, table.name)
+		if err != nil {
+			problems = []string{err.Error()}
+		} else {
+			problems = table.problems(columns)
+		}
+
+		checks = append(checks, newReadinessCheck("table:"+table.name, problems))
+	}
+
+	return checks
+}
+
+func checkReadiness(ctx context.Context) readinessResponse {
+	checks := checkDatabase(ctx)
+
+	var problems []string
+	if currentCFModel() == nil {
+		problems = append(problems, "collaborative filtering model not loaded")
+	}
+
+	checks = append(checks, newReadinessCheck("cfModel", problems))
+
+	response := readinessResponse{Ready: true, Checks: checks}
+	for _, check := range checks {
+		if !check.Ok {
+			response.Ready = false
+		}
+	}
+
+	return response
+}
+
+func handleHealth(rw http.ResponseWriter, req *http.Request) {
+	js, err := json.Marshal(healthResponse{Status: "ok"})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Write(js)
+}
+
+func handleReadiness(rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+
+	response := checkReadiness(ctx)
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if !response.Ready {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	rw.Write(js)
+}
@@ -0,0 +1,545 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+const (
+	historyEventAccess  = "access"
+	historyEventVisited = "visited"
+	historyEventLike    = "like"
+	historyEventDislike = "dislike"
+	historyEventRating  = "rating"
+)
+
+var defaultEventWeights = map[string]float64{
+	historyEventAccess:  1.0,
+	historyEventVisited: 2.0,
+	historyEventLike:    3.0,
+	historyEventDislike: -3.0,
+	historyEventRating:  3.0,
+}
+
+type historyEntry struct {
+	Date       string             `json:"date"`
+	Event      string             `json:"event"`
+	EventValue float64            `json:"eventValue"`
+	Id         int                `json:"id"`
+	Name       string             `json:"name"`
+	Profile    map[string]float64 `json:"profile"`
+	ReviewId   int                `json:"reviewId"`
+}
+
+type historyResponse struct {
+	Entries []historyEntry `json:"entries"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+	Total   int            `json:"total"`
+}
+
+type historyRangeRequest struct {
+	From     string `json:"from"`
+	ReviewId int    `json:"reviewId"`
+	To       string `json:"to"`
+}
+
+type historyRangeResponse struct {
+	Count int64 `json:"count"`
+}
+
+type feedbackRequest struct {
+	Event     string             `json:"event"`
+	Id        int                `json:"id"`
+	Profile   map[string]float64 `json:"profile"`
+	ProfileId int                `json:"profileId"`
+	Rating    float64            `json:"rating"`
+}
+
+type historyFilter struct {
+	from     string
+	to       string
+	reviewId int
+}
+
+func (f historyFilter) where(user string) (string, []interface{}) {
+	clauses := []string{"history.userId = (?)"}
+	args := []interface{}{user}
+
+	if len(f.from) > 0 {
+		clauses = append(clauses, "history.date >= DATETIME(?)")
+		args = append(args, f.from)
+	}
+
+	if len(f.to) > 0 {
+		clauses = append(clauses, "history.date < DATETIME(?)")
+		args = append(args, f.to)
+	}
+
+	if f.reviewId != 0 {
+		clauses = append(clauses, "history.reviewId = (?)")
+		args = append(args, f.reviewId)
+	}
+
+	return strings.Join(clauses, " AND "), args
+}
+
+var historyDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseHistoryDate accepts RFC 3339 timestamps, or dates and times without a
+// zone which are taken to be UTC, and returns them in the format history
+// dates are stored in.
+func parseHistoryDate(value string) (string, error) {
+	for _, layout := range historyDateLayouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date.UTC().Format("2006-01-02 15:04:05"), nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid date %q", value)
+}
+
+func newHistoryFilter(from, to string, reviewId int) (historyFilter, error) {
+	filter := historyFilter{reviewId: reviewId}
+
+	var err error
+	if len(from) > 0 {
+		if filter.from, err = parseHistoryDate(from); err != nil {
+			return filter, err
+		}
+	}
+
+	if len(to) > 0 {
+		if filter.to, err = parseHistoryDate(to); err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+func parseHistoryFilter(req *http.Request) (historyFilter, error) {
+	values := req.URL.Query()
+
+	var reviewId int
+	if value := values.Get("reviewId"); len(value) > 0 {
+		var err error
+		if reviewId, err = strconv.Atoi(value); err != nil {
+			return historyFilter{}, fmt.Errorf("invalid reviewId %q", value)
+		}
+	}
+
+	return newHistoryFilter(values.Get("from"), values.Get("to"), reviewId)
+}
+
+// eventWeight returns the signed weight of a history event; star ratings are
+// centered so that a rating of 3 is neutral and 1 or 5 carry the full weight.
+func eventWeight(event string, value float64, weights map[string]float64) float64 {
+	weight, ok := weights[event]
+	if !ok {
+		weight = defaultEventWeights[event]
+	}
+
+	if event == historyEventRating {
+		weight *= (value - 3) / 2
+	}
+
+	return weight
+}
+
+// recordHistory logs an event together with the profile it was issued with,
+// which callers validate against specs beforehand; values for categories
+// missing from specs are not stored.
+func recordHistory(db *sql.DB, specs map[string]categorySpec, user string, reviewId int, event string, value float64, profile map[string]float64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO history(date, reviewId, userId, event, eventValue) VALUES(DATETIME('now'), ?, ?, ?, ?)",
+		reviewId,
+		user,
+		event,
+		value,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	insertId, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for id, value := range profile {
+		if _, ok := specs[id]; !ok {
+			continue
+		}
+
+		if _, err := tx.Exec("INSERT INTO historyGroups(categoryId, categoryValue, historyId) VALUES(?, ?, ?)", id, value, insertId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func fetchHistory(db *sql.DB, user string, filter historyFilter, offset, limit int) ([]historyEntry, int, error) {
+	where, args := filter.where(user)
+
+	// The count and the page share their source so that entries whose
+	// restaurant no longer exists are neither listed nor counted.
+	from := "FROM history JOIN reviews ON reviews.id = history.reviewId WHERE " + where
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) "+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(
+		"SELECT history.id, history.date, history.event, history.eventValue, history.reviewId, reviews.name "+from+" ORDER BY history.date DESC, history.id DESC LIMIT (?) OFFSET (?)",
+		append(args, limit, offset)...,
+	)
+
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var (
+		entries []historyEntry
+		ids     []interface{}
+		indices = make(map[int]int)
+	)
+
+	for rows.Next() {
+		entry := historyEntry{Profile: make(map[string]float64)}
+		if err := rows.Scan(&entry.Id, &entry.Date, &entry.Event, &entry.EventValue, &entry.ReviewId, &entry.Name); err != nil {
+			return nil, 0, err
+		}
+
+		indices[entry.Id] = len(entries)
+		ids = append(ids, entry.Id)
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if len(ids) == 0 {
+		return entries, total, nil
+	}
+
+	groupRows, err := db.Query(
+		"SELECT historyId, categoryId, categoryValue FROM historyGroups WHERE historyId IN (?"+strings.Repeat(", ?", len(ids)-1)+")",
+		ids...,
+	)
+
+	if err != nil {
+		return nil, 0, err
+	}
+	defer groupRows.Close()
+
+	for groupRows.Next() {
+		var (
+			historyId, categoryId int
+			categoryValue         float64
+		)
+
+		if err := groupRows.Scan(&historyId, &categoryId, &categoryValue); err != nil {
+			return nil, 0, err
+		}
+
+		entries[indices[historyId]].Profile[strconv.Itoa(categoryId)] = categoryValue
+	}
+
+	if err := groupRows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return entries, total, nil
+}
+
+func deleteHistoryTx(tx *sql.Tx, where string, args ...interface{}) (int64, error) {
+	if _, err := tx.Exec("DELETE FROM historyGroups WHERE historyId IN (SELECT id FROM history WHERE "+where+")", args...); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("DELETE FROM history WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func deleteHistory(db *sql.DB, where string, args ...interface{}) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count, err := deleteHistoryTx(tx, where, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, tx.Commit()
+}
+
+func handleFeedbackReview(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		request  feedbackRequest
+		response successResponse
+	)
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := defaultEventWeights[request.Event]; !ok || request.Event == historyEventAccess {
+		http.Error(rw, "invalid feedback event", http.StatusInternalServerError)
+		return
+	}
+
+	if request.Event == historyEventRating && (request.Rating < 1 || request.Rating > 5) {
+		http.Error(rw, "invalid rating", http.StatusInternalServerError)
+		return
+	}
+
+	user := requestUser(req)
+
+	profile, err := resolveProfile(db, user, request.ProfileId, request.Profile)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var reviewExists int
+	if err := db.QueryRow("SELECT EXISTS(SELECT NULL FROM reviews WHERE id = ?)", request.Id).Scan(&reviewExists); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if reviewExists == 0 || len(profile) == 0 {
+		http.Error(rw, "invalid profile", http.StatusInternalServerError)
+		return
+	}
+
+	specs, err := loadCategorySpecs(db, user)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := validateProfile(specs, profile); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := recordHistory(db, specs, user, request.Id, request.Event, request.Rating, profile); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Success = true
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleGetHistory(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var response historyResponse
+
+	filter, err := parseHistoryFilter(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response.Limit = defaultHistoryLimit
+	if limit := req.URL.Query().Get("limit"); len(limit) > 0 {
+		if response.Limit, err = strconv.Atoi(limit); err != nil || response.Limit < 1 {
+			http.Error(rw, fmt.Sprintf("invalid limit %q", limit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if response.Limit > maxHistoryLimit {
+		response.Limit = maxHistoryLimit
+	}
+
+	if offset := req.URL.Query().Get("offset"); len(offset) > 0 {
+		if response.Offset, err = strconv.Atoi(offset); err != nil || response.Offset < 0 {
+			http.Error(rw, fmt.Sprintf("invalid offset %q", offset), http.StatusBadRequest)
+			return
+		}
+	}
+
+	response.Entries, response.Total, err = fetchHistory(db, requestUser(req), filter, response.Offset, response.Limit)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleRemoveHistoryEntry(rw http.ResponseWriter, req *http.Request) {
+	id, err := pathId(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var response successResponse
+
+	count, err := deleteHistory(db, "history.id = (?) AND history.userId = (?)", id, requestUser(req))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Success = count > 0
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleRemoveHistoryRange(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		filter   historyFilter
+		response historyRangeResponse
+	)
+
+	if isVersionedDelete(req) {
+		if filter, err = parseHistoryFilter(req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var request historyRangeRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if filter, err = newHistoryFilter(request.From, request.To, request.ReviewId); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if len(filter.from) == 0 && len(filter.to) == 0 {
+		http.Error(rw, "range requires from or to", http.StatusBadRequest)
+		return
+	}
+
+	where, args := filter.where(requestUser(req))
+
+	if response.Count, err = deleteHistory(db, where, args...); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
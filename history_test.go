@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"testing"
+)
+
+func TestEventWeight(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   string
+		value   float64
+		weights map[string]float64
+		want    float64
+	}{
+		{"access", historyEventAccess, 0, nil, 1},
+		{"like", historyEventLike, 0, nil, 3},
+		{"dislike", historyEventDislike, 0, nil, -3},
+		{"unknown event", "share", 0, nil, 0},
+		{"top rating", historyEventRating, 5, nil, 3},
+		{"good rating", historyEventRating, 4, nil, 1.5},
+		{"neutral rating", historyEventRating, 3, nil, 0},
+		{"bottom rating", historyEventRating, 1, nil, -3},
+		{"custom weight", historyEventAccess, 0, map[string]float64{historyEventAccess: 0.5}, 0.5},
+		{"custom rating weight", historyEventRating, 5, map[string]float64{historyEventRating: 2}, 2},
+		{"default for missing override", historyEventVisited, 0, map[string]float64{historyEventAccess: 0.5}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := eventWeight(test.event, test.value, test.weights); !approxEqual(got, test.want) {
+				t.Errorf("eventWeight(%q, %v) = %v, want %v", test.event, test.value, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	logLevelDebug logLevel = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+type logFormat int
+
+const (
+	logFormatText logFormat = iota
+	logFormatJSON
+)
+
+type logger struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	level  logLevel
+	format logFormat
+}
+
+// requestLog collects fields that handlers attach to the access log entry of
+// the request they are serving.
+type requestLog struct {
+	mutex  sync.Mutex
+	id     string
+	fields []interface{}
+}
+
+type requestLogKey struct{}
+
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+// stdLogWriter routes output of the standard log package through appLog so
+// that every line shares the configured format.
+type stdLogWriter struct{}
+
+const requestIdHeader = "X-Request-Id"
+
+var appLog = &logger{out: os.Stderr, level: logLevelInfo}
+
+func (l logLevel) String() string {
+	switch l {
+	case logLevelDebug:
+		return "debug"
+	case logLevelWarn:
+		return "warn"
+	case logLevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return logLevelDebug, nil
+	case "", "info":
+		return logLevelInfo, nil
+	case "warn", "warning":
+		return logLevelWarn, nil
+	case "error":
+		return logLevelError, nil
+	default:
+		return logLevelInfo, fmt.Errorf("unknown log level %s", name)
+	}
+}
+
+func parseLogFormat(name string) (logFormat, error) {
+	switch strings.ToLower(name) {
+	case "", "text":
+		return logFormatText, nil
+	case "json":
+		return logFormatJSON, nil
+	default:
+		return logFormatText, fmt.Errorf("unknown log format %s", name)
+	}
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	appLog.log(logLevelInfo, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// configureLogging applies the level and format of options to appLog and
+// redirects the standard logger through it.
+func configureLogging(options Options) error {
+	level, err := parseLogLevel(options.LogLevel)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseLogFormat(options.LogFormat)
+	if err != nil {
+		return err
+	}
+
+	appLog.mutex.Lock()
+	appLog.level = level
+	appLog.format = format
+	appLog.mutex.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+
+	return nil
+}
+
+// logValue converts durations to fractional milliseconds and errors to their
+// message so that both formats print them the same way.
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Duration:
+		return math.Round(float64(v)/float64(time.Microsecond)) / 1000
+	case error:
+		return v.Error()
+	default:
+		return v
+	}
+}
+
+func formatLogValue(value interface{}) string {
+	switch v := logValue(value).(type) {
+	case string:
+		if len(v) == 0 || strings.ContainsAny(v, " \"=") {
+			return strconv.Quote(v)
+		}
+
+		return v
+	case bool, int, int64, float64:
+		return fmt.Sprint(v)
+	default:
+		js, err := json.Marshal(v)
+		if err != nil {
+			return strconv.Quote(fmt.Sprint(v))
+		}
+
+		return string(js)
+	}
+}
+
+func writeJSONValue(b *bytes.Buffer, value interface{}) {
+	js, err := json.Marshal(logValue(value))
+	if err != nil {
+		js, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	b.Write(js)
+}
+
+func (l *logger) log(level logLevel, msg string, fields ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	var (
+		b   bytes.Buffer
+		now = time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	)
+
+	switch l.format {
+	case logFormatJSON:
+		b.WriteString(`{"time":`)
+		writeJSONValue(&b, now)
+		b.WriteString(`,"level":`)
+		writeJSONValue(&b, level.String())
+		b.WriteString(`,"msg":`)
+		writeJSONValue(&b, msg)
+
+		for i := 0; i+1 < len(fields); i += 2 {
+			b.WriteByte(',')
+			writeJSONValue(&b, fmt.Sprint(fields[i]))
+			b.WriteByte(':')
+			writeJSONValue(&b, fields[i+1])
+		}
+
+		b.WriteString("}\n")
+	default:
+		fmt.Fprintf(&b, "%s %s %s", now, strings.ToUpper(level.String()), msg)
+
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&b, " %v=%s", fields[i], formatLogValue(fields[i+1]))
+		}
+
+		b.WriteByte('\n')
+	}
+
+	l.out.Write(b.Bytes())
+}
+
+// logDebug, logInfo and logError write msg followed by the key/value
+// pairs taken from fields at the corresponding level.
+func logDebug(msg string, fields ...interface{}) {
+	appLog.log(logLevelDebug, msg, fields...)
+}
+
+func logInfo(msg string, fields ...interface{}) {
+	appLog.log(logLevelInfo, msg, fields...)
+}
+
+func logError(msg string, fields ...interface{}) {
+	appLog.log(logLevelError, msg, fields...)
+}
+
+// logFields attaches key/value pairs to the access log entry of the request
+// carried by ctx; it does nothing outside of logRequests.
+func logFields(ctx context.Context, fields ...interface{}) {
+	if entry, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		entry.mutex.Lock()
+		entry.fields = append(entry.fields, fields...)
+		entry.mutex.Unlock()
+	}
+}
+
+// requestId returns the id assigned to the request carried by ctx.
+func requestId(ctx context.Context) string {
+	if entry, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return entry.id
+	}
+
+	return ""
+}
+
+func validRequestId(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:/+=", c):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestId() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return hex.EncodeToString(id[:])
+}
+
+// logRequests propagates the X-Request-Id header of incoming requests, or
+// assigns a new id, and writes one access log entry per request.
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		entry := &requestLog{id: req.Header.Get(requestIdHeader)}
+		if !validRequestId(entry.id) {
+			entry.id = newRequestId()
+		}
+
+		rw.Header().Set(requestIdHeader, entry.id)
+
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+
+		recorder := &statusRecorder{ResponseWriter: rw}
+		handler.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), requestLogKey{}, entry)))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		level := logLevelInfo
+		switch {
+		case recorder.status >= http.StatusInternalServerError:
+			level = logLevelError
+		case recorder.status >= http.StatusBadRequest:
+			level = logLevelWarn
+		case req.URL.Path == "/healthz" || req.URL.Path == "/readyz":
+			// Successful orchestrator probes would otherwise dominate the log.
+			level = logLevelDebug
+		}
+
+		fields := []interface{}{
+			"requestId", entry.id,
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", recorder.status,
+			"latencyMs", time.Since(start),
+			"requestBytes", body.bytes,
+			"responseBytes", recorder.bytes,
+			"remote", req.RemoteAddr,
+		}
+
+		entry.mutex.Lock()
+		fields = append(fields, entry.fields...)
+		entry.mutex.Unlock()
+
+		appLog.log(level, "request", fields...)
+	})
+}
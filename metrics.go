@@ -0,0 +1,317 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	labelEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+var (
+	httpRequests = newCounterVec(
+		"search_http_requests_total",
+		"HTTP requests handled, by endpoint, method and status code.",
+	)
+	httpDuration = newHistogramVec(
+		"search_http_request_duration_seconds",
+		"HTTP request latency, by endpoint.",
+		latencyBuckets,
+	)
+	queryStageDuration = newHistogramVec(
+		"search_query_stage_duration_seconds",
+		"Time spent in each stage of a query: fetch (loading and annotating records), scoring and projection.",
+		latencyBuckets,
+	)
+	queryMatchedRecords = newHistogramVec(
+		"search_query_matched_records",
+		"Records matched per query.",
+		[]float64{0, 10, 50, 100, 250, 500, 1000, 2500},
+	)
+	dbQueryDuration = newHistogramVec(
+		"search_db_query_duration_seconds",
+		"Database query time, including row scanning, by query.",
+		latencyBuckets,
+	)
+)
+
+type counterVec struct {
+	name   string
+	help   string
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogram
+}
+
+// queryTimings accumulates the stage durations of a single request; it
+// travels in the request context so that database helpers can report into it.
+type queryTimings struct {
+	mutex      sync.Mutex
+	db         time.Duration
+	fetch      time.Duration
+	scoring    time.Duration
+	projection time.Duration
+}
+
+type queryTimingsKey struct{}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func metricLabels(pairs ...string) string {
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+
+	return strings.Join(labels, ",")
+}
+
+func seriesName(name, labels string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	return name + "{" + labels + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func newCounterVec(name, help string) *counterVec {
+	return &counterVec{name: name, help: help, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(labels string) {
+	c.mutex.Lock()
+	c.values[labels]++
+	c.mutex.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for labels := range c.values {
+		keys = append(keys, labels)
+	}
+
+	sort.Strings(keys)
+
+	for _, labels := range keys {
+		fmt.Fprintf(w, "%s %s\n", seriesName(c.name, labels), formatFloat(c.values[labels]))
+	}
+}
+
+func newHistogramVec(name, help string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(labels string, value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	series, ok := h.series[labels]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[labels] = series
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+
+	series.sum += value
+	series.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for labels := range h.series {
+		keys = append(keys, labels)
+	}
+
+	sort.Strings(keys)
+
+	for _, labels := range keys {
+		series := h.series[labels]
+
+		prefix := labels
+		if len(prefix) > 0 {
+			prefix += ","
+		}
+
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatFloat(bound), series.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, series.count)
+		fmt.Fprintf(w, "%s %s\n", seriesName(h.name+"_sum", labels), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s %d\n", seriesName(h.name+"_count", labels), series.count)
+	}
+}
+
+func withQueryTimings(ctx context.Context) (context.Context, *queryTimings) {
+	timings := new(queryTimings)
+	return context.WithValue(ctx, queryTimingsKey{}, timings), timings
+}
+
+func queryTimingsFrom(ctx context.Context) *queryTimings {
+	timings, _ := ctx.Value(queryTimingsKey{}).(*queryTimings)
+	return timings
+}
+
+// observeDB records the time taken by a named database query since start, in
+// the process metrics and in the timings of the request carried by ctx.
+func observeDB(ctx context.Context, name string, start time.Time) {
+	elapsed := time.Since(start)
+	dbQueryDuration.observe(metricLabels("query", name), elapsed.Seconds())
+
+	if timings := queryTimingsFrom(ctx); timings != nil {
+		timings.mutex.Lock()
+		timings.db += elapsed
+		timings.mutex.Unlock()
+	}
+}
+
+// observeStage records the time taken by a query stage since start and
+// returns it.
+func observeStage(stage string, start time.Time) time.Duration {
+	elapsed := time.Since(start)
+	queryStageDuration.observe(metricLabels("stage", stage), elapsed.Seconds())
+	return elapsed
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+// Flush forwards to the underlying writer so that streaming handlers keep
+// working behind the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument counts requests and records their latency under the given
+// endpoint name, which should be a mux pattern to keep label sets bounded.
+// metricMethod maps the request method onto a fixed set of label values so
+// that clients cannot create arbitrary series.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+func instrument(endpoint string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		recorder := &statusRecorder{ResponseWriter: rw}
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		httpRequests.inc(metricLabels("code", strconv.Itoa(recorder.status), "endpoint", endpoint, "method", metricMethod(req.Method)))
+		httpDuration.observe(metricLabels("endpoint", endpoint), time.Since(start).Seconds())
+	})
+}
+
+func handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	var buff bytes.Buffer
+
+	httpRequests.write(&buff)
+	httpDuration.write(&buff)
+	queryStageDuration.write(&buff)
+	queryMatchedRecords.write(&buff)
+	dbQueryDuration.write(&buff)
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.Write(buff.Bytes())
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type openAPISchemas map[string]interface{}
+
+func (s openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return s.object(t)
+		}
+
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = nil
+			s[t.Name()] = s.object(t)
+		}
+
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (s openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	s.fields(t, properties)
+
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func (s openAPISchemas) fields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(tag, ",")
+		if field.Anonymous && len(name) == 0 && field.Type.Kind() == reflect.Struct {
+			s.fields(field.Type, properties)
+			continue
+		}
+
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		properties[name] = s.schema(field.Type)
+	}
+}
+
+func openAPIOperation(route apiRoute, schemas openAPISchemas) map[string]interface{} {
+	user := "#/components/parameters/userId"
+	if route.identified {
+		user = "#/components/parameters/requiredUserId"
+	}
+
+	parameters := []interface{}{
+		map[string]interface{}{"$ref": user},
+	}
+
+	for _, param := range route.params {
+		parameters = append(parameters, map[string]interface{}{
+			"name":        param.name,
+			"in":          param.in,
+			"required":    param.in == "path",
+			"description": param.description,
+			"schema":      map[string]interface{}{"type": param.kind},
+		})
+	}
+
+	success := map[string]interface{}{"description": "OK"}
+	if route.response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(route.response))},
+		}
+	} else if len(route.produces) > 0 {
+		content := make(map[string]interface{})
+		for _, contentType := range route.produces {
+			content[contentType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+		}
+
+		success["content"] = content
+	}
+
+	errorResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{
+				"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			},
+		}
+	}
+
+	responses := map[string]interface{}{
+		"200": success,
+		"405": map[string]interface{}{"description": "Method not allowed"},
+		"500": errorResponse("Error"),
+	}
+
+	switch {
+	case route.identified:
+		responses["400"] = errorResponse("Invalid parameters or missing user id")
+	case route.request != nil || len(route.params) > 0:
+		responses["400"] = errorResponse("Invalid parameters")
+	}
+
+	if len(route.notFound) > 0 {
+		responses["404"] = errorResponse(route.notFound)
+	}
+
+	operation := map[string]interface{}{
+		"summary":    route.summary,
+		"parameters": parameters,
+		"responses":  responses,
+	}
+
+	if route.admin {
+		responses["401"] = map[string]interface{}{"description": "Missing or invalid admin token"}
+		operation["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+	}
+
+	// DELETE bodies have no defined semantics, so those routes take their
+	// arguments as parameters.
+	if route.request != nil && route.method != http.MethodDelete {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(route.request))},
+			},
+		}
+	}
+
+	return operation
+}
+
+// openAPIDocument describes the versioned API; request and response schemas
+// are reflected from the same types the handlers decode and encode, so the
+// document cannot drift from the implementation.
+func openAPIDocument(routes []apiRoute) map[string]interface{} {
+	var (
+		paths   = make(map[string]interface{})
+		schemas = make(openAPISchemas)
+	)
+
+	for _, route := range routes {
+		operations, ok := paths[route.path].(map[string]interface{})
+		if !ok {
+			operations = make(map[string]interface{})
+			paths[route.path] = operations
+		}
+
+		operations[strings.ToLower(route.method)] = openAPIOperation(route, schemas)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Restaurant Search API",
+			"version": "1",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": apiPrefix},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"parameters": map[string]interface{}{
+				"userId": map[string]interface{}{
+					"name":        "X-User-Id",
+					"in":          "header",
+					"required":    false,
+					"description": "Identifies the user whose history and categories are used",
+					"schema":      map[string]interface{}{"type": "string"},
+				},
+				"requiredUserId": map[string]interface{}{
+					"name":        "X-User-Id",
+					"in":          "header",
+					"required":    true,
+					"description": "Identifies the user whose history and categories are modified",
+					"schema":      map[string]interface{}{"type": "string"},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Token configured with the admin-token option",
+				},
+			},
+		},
+	}
+}
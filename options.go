@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Options configures the application returned by NewSearchApp.
+type Options struct {
+	// Addr is the address servers built from these options listen on.
+	Addr string
+
+	// AreasPath and StationsPath default to areas.geojson and stations.json
+	// next to the database; both files are optional.
+	AreasPath    string
+	StationsPath string
+
+	DataPath string
+
+	// StaticPath serves the web UI from a directory on disk instead of the
+	// copy embedded in the binary, which is useful during development.
+	StaticPath string
+
+	// Features and Modes provide the default value and mode of each feature
+	// for queries that leave them unspecified.
+	Features map[string]float64
+	Modes    map[string]string
+
+	// LogLevel is one of debug, info (the default), warn or error and
+	// LogFormat is either text (the default) or json.
+	LogLevel  string
+	LogFormat string
+
+	// AdminToken enables the administrative endpoints, which then require it
+	// as a bearer token; they are not served when it is empty.
+	AdminToken string
+}
+
+var (
+	defaultFeatures map[string]float64
+	defaultModes    map[string]modeType
+)
+
+func (o *Options) resolve() error {
+	if len(o.DataPath) == 0 {
+		return errors.New("database path not configured")
+	}
+
+	if _, err := os.Stat(o.DataPath); err != nil {
+		return err
+	}
+
+	if len(o.StaticPath) > 0 {
+		info, err := os.Stat(o.StaticPath)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", o.StaticPath)
+		}
+	}
+
+	if len(o.AreasPath) == 0 {
+		o.AreasPath = filepath.Join(filepath.Dir(o.DataPath), "areas.geojson")
+	}
+
+	if len(o.StationsPath) == 0 {
+		o.StationsPath = filepath.Join(filepath.Dir(o.DataPath), "stations.json")
+	}
+
+	known := fixFeatures(nil)
+	for name := range o.Features {
+		if _, ok := known[name]; !ok {
+			return fmt.Errorf("unknown feature %s", name)
+		}
+	}
+
+	for name, value := range o.Modes {
+		if _, ok := known[name]; !ok {
+			return fmt.Errorf("unknown feature %s", name)
+		}
+
+		if _, err := parseModeType(value); err != nil {
+			return fmt.Errorf("feature %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
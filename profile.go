@@ -0,0 +1,322 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type savedProfile struct {
+	Id      int                `json:"id"`
+	Name    string             `json:"name"`
+	Updated string             `json:"updated"`
+	Values  map[string]float64 `json:"values"`
+}
+
+type saveProfileRequest struct {
+	Id     int                `json:"id"`
+	Name   string             `json:"name"`
+	Values map[string]float64 `json:"values"`
+}
+
+type saveProfileResponse struct {
+	Id      int  `json:"id"`
+	Success bool `json:"success"`
+}
+
+type removeProfileRequest struct {
+	Id int `json:"id"`
+}
+
+func fetchProfiles(db *sql.DB, user string) ([]savedProfile, error) {
+	rows, err := db.Query(`
+		SELECT profiles.id, profiles.name, profiles.updated, profileValues.categoryId, profileValues.value
+		FROM profiles LEFT JOIN profileValues ON profileValues.profileId = profiles.id
+		WHERE profiles.userId = (?)
+		ORDER BY profiles.name, profiles.id`, user)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		profiles []savedProfile
+		indices  = make(map[int]int)
+	)
+
+	for rows.Next() {
+		var (
+			id            int
+			name, updated string
+			categoryId    sql.NullInt64
+			value         sql.NullFloat64
+		)
+
+		if err := rows.Scan(&id, &name, &updated, &categoryId, &value); err != nil {
+			return nil, err
+		}
+
+		index, ok := indices[id]
+		if !ok {
+			index = len(profiles)
+			indices[id] = index
+			profiles = append(profiles, savedProfile{id, name, updated, make(map[string]float64)})
+		}
+
+		if categoryId.Valid {
+			profiles[index].Values[strconv.FormatInt(categoryId.Int64, 10)] = value.Float64
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+func loadProfile(db *sql.DB, user string, id int) (map[string]float64, error) {
+	var exists int
+	if err := db.QueryRow("SELECT EXISTS(SELECT NULL FROM profiles WHERE id = (?) AND userId = (?))", id, user).Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	if exists == 0 {
+		return nil, errors.New("unknown profile")
+	}
+
+	rows, err := db.Query("SELECT categoryId, value FROM profileValues WHERE profileId = (?)", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	profile := make(map[string]float64)
+	for rows.Next() {
+		var (
+			categoryId int
+			value      float64
+		)
+
+		if err := rows.Scan(&categoryId, &value); err != nil {
+			return nil, err
+		}
+
+		profile[strconv.Itoa(categoryId)] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// resolveProfile returns the stored profile when an id is given, and the
+// profile sent with the request otherwise.
+func resolveProfile(db *sql.DB, user string, id int, profile map[string]float64) (map[string]float64, error) {
+	if id == 0 {
+		return profile, nil
+	}
+
+	return loadProfile(db, user, id)
+}
+
+func saveProfile(db *sql.DB, user string, id int, name string, values map[string]float64) (int, error) {
+	specs, err := loadCategorySpecs(db, user)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := validateProfile(specs, values); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if id == 0 {
+		result, err := tx.Exec("INSERT INTO profiles(name, userId, updated) VALUES(?, ?, DATETIME('now'))", name, user)
+		if err != nil {
+			return 0, err
+		}
+
+		insertId, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+
+		id = int(insertId)
+	} else {
+		result, err := tx.Exec("UPDATE profiles SET name = (?), updated = DATETIME('now') WHERE id = (?) AND userId = (?)", name, id, user)
+		if err != nil {
+			return 0, err
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		if rows == 0 {
+			return 0, errors.New("unknown profile")
+		}
+
+		if _, err := tx.Exec("DELETE FROM profileValues WHERE profileId = (?)", id); err != nil {
+			return 0, err
+		}
+	}
+
+	for categoryId, value := range values {
+		if _, ok := specs[categoryId]; !ok {
+			continue
+		}
+
+		if _, err := tx.Exec("INSERT INTO profileValues(profileId, categoryId, value) VALUES(?, ?, ?)", id, categoryId, value); err != nil {
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+func handleGetProfiles(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	response, err := fetchProfiles(db, requestUser(req))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleSaveProfile(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		request  saveProfileRequest
+		response saveProfileResponse
+	)
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if len(name) == 0 {
+		http.Error(rw, "invalid profile name", http.StatusInternalServerError)
+		return
+	}
+
+	if response.Id, err = saveProfile(db, requestUser(req), request.Id, name, request.Values); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Success = true
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleRemoveProfile(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		request  removeProfileRequest
+		response successResponse
+	)
+
+	if isVersionedDelete(req) {
+		if request.Id, err = pathId(req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM profiles WHERE id = (?) AND userId = (?)", request.Id, requestUser(req))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response.Success = rows > 0
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
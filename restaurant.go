@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+const (
+	defaultNearestStations = 3
+	maxNearestStations     = 20
+)
+
+type stationDistance struct {
+	Distance float64 `json:"distance"`
+	Geo      geoData `json:"geo"`
+	Name     string  `json:"name"`
+}
+
+type historySummary struct {
+	Events    map[string]int `json:"events"`
+	LastEvent string         `json:"lastEvent,omitempty"`
+	Total     int            `json:"total"`
+	User      int            `json:"user"`
+}
+
+type reviewSource struct {
+	Count    int64              `json:"count"`
+	Features map[string]float64 `json:"features"`
+	Site     string             `json:"site"`
+	Url      string             `json:"url"`
+}
+
+type restaurantDetail struct {
+	Features map[string]float64 `json:"features"`
+	History  historySummary     `json:"history"`
+	Record   record             `json:"record"`
+	Sources  []reviewSource     `json:"sources"`
+	Stations []stationDistance  `json:"stations"`
+}
+
+func nearestStations(entry record, count int) []stationDistance {
+	entryPoint := geo.NewPoint(entry.Geo.Latitude, entry.Geo.Longitude)
+
+	var stations []stationDistance
+	for name, stn := range stationGeo {
+		distance := entryPoint.GreatCircleDistance(geo.NewPoint(stn.Latitude, stn.Longitude))
+		stations = append(stations, stationDistance{distance, stn, name})
+	}
+
+	if len(stations) == 0 && len(entry.ClosestStn) > 0 {
+		return []stationDistance{{Distance: entry.DistanceToStn, Name: entry.ClosestStn}}
+	}
+
+	sort.Slice(stations, func(i, j int) bool {
+		return stations[i].Distance < stations[j].Distance
+	})
+
+	if len(stations) > count {
+		stations = stations[:count]
+	}
+
+	return stations
+}
+
+func fetchHistorySummary(db *sql.DB, user string, reviewId int) (historySummary, error) {
+	summary := historySummary{Events: make(map[string]int)}
+
+	rows, err := db.Query(
+		"SELECT event, COUNT(*), SUM(userId = (?)), STRFTIME('%Y-%m-%dT%H:%M:%SZ', MAX(date)) FROM history WHERE reviewId = (?) GROUP BY event",
+		user,
+		reviewId,
+	)
+
+	if err != nil {
+		return summary, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			event, lastEvent string
+			total, userTotal int
+		)
+
+		// Aggregates lose the column type, so the date is formatted as
+		// RFC 3339 here to match the dates of history entries.
+		if err := rows.Scan(&event, &total, &userTotal, &lastEvent); err != nil {
+			return summary, err
+		}
+
+		summary.Events[event] = total
+		summary.Total += total
+		summary.User += userTotal
+
+		if lastEvent > summary.LastEvent {
+			summary.LastEvent = lastEvent
+		}
+	}
+
+	return summary, rows.Err()
+}
+
+func fetchSources(db *sql.DB, reviewId int) ([]reviewSource, error) {
+	rows, err := db.Query("SELECT url, count, features FROM sources WHERE reviewId = (?) ORDER BY count DESC", reviewId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := make([]reviewSource, 0)
+	for rows.Next() {
+		var (
+			source   reviewSource
+			features string
+		)
+
+		if err := rows.Scan(&source.Url, &source.Count, &features); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(features), &source.Features); err != nil {
+			return nil, err
+		}
+
+		if u, err := url.Parse(source.Url); err == nil {
+			source.Site = u.Host
+		}
+
+		sources = append(sources, source)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+func handleGetRestaurant(rw http.ResponseWriter, req *http.Request) {
+	id, err := pathId(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		response restaurantDetail
+		values   = req.URL.Query()
+		user     = requestUser(req)
+	)
+
+	var profileId int
+	if value := values.Get("profileId"); len(value) > 0 {
+		if profileId, err = strconv.Atoi(value); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	stationCount := defaultNearestStations
+	if value := values.Get("stations"); len(value) > 0 {
+		if stationCount, err = strconv.Atoi(value); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if stationCount < 0 || stationCount > maxNearestStations {
+		http.Error(rw, fmt.Sprintf("stations must be between 0 and %d", maxNearestStations), http.StatusBadRequest)
+		return
+	}
+
+	profile, err := resolveProfile(db, user, profileId, nil)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entry, err := fetchRecord(db, queryContext{ctx: req.Context(), profile: profile, user: user}, id)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if entry == nil {
+		http.Error(rw, "unknown restaurant", http.StatusNotFound)
+		return
+	}
+
+	response.Record = *entry
+	// nearby and accessible are relative to the location and result set of a
+	// query, which a single restaurant lookup does not have.
+	response.Features = make(map[string]float64)
+	for name, value := range entry.features {
+		if name != "nearby" && name != "accessible" {
+			response.Features[name] = value
+		}
+	}
+	response.Stations = nearestStations(*entry, stationCount)
+
+	if response.History, err = fetchHistorySummary(db, user, id); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if response.Sources, err = fetchSources(db, id); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const defaultRetentionInterval = time.Hour
+
+// RetentionPolicy limits how much access history is kept in the database at
+// DataPath. A zero MaxAge or MaxRows disables the corresponding limit.
+type RetentionPolicy struct {
+	DataPath string
+	Interval time.Duration
+	MaxAge   time.Duration
+	MaxRows  int
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.MaxAge > 0 || p.MaxRows > 0
+}
+
+func purgeHistory(db *sql.DB, policy RetentionPolicy) (expired, excess int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if policy.MaxAge > 0 {
+		modifier := fmt.Sprintf("-%d seconds", int64(policy.MaxAge.Seconds()))
+		if expired, err = deleteHistoryTx(tx, "history.date < DATETIME('now', ?)", modifier); err != nil {
+			return
+		}
+	}
+
+	if policy.MaxRows > 0 {
+		where := `history.id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY userId ORDER BY date DESC, id DESC) AS position FROM history
+			) WHERE position > (?))`
+
+		if excess, err = deleteHistoryTx(tx, where, policy.MaxRows); err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+func enforceRetention(policy RetentionPolicy) {
+	db, err := openDatabaseAt(policy.DataPath)
+	if err != nil {
+		logError("retention failed", "error", err)
+		return
+	}
+	defer db.Close()
+
+	expired, excess, err := purgeHistory(db, policy)
+	if err != nil {
+		logError("retention failed", "error", err)
+		return
+	}
+
+	if expired > 0 || excess > 0 {
+		logInfo("retention purged history", "expired", expired, "excess", excess)
+	}
+}
+
+// StartRetention enforces the retention policy immediately and then
+// periodically from a background goroutine until the returned stop function
+// is called.
+func StartRetention(policy RetentionPolicy) (stop func(), err error) {
+	if !policy.enabled() {
+		return func() {}, nil
+	}
+
+	if len(policy.DataPath) == 0 {
+		return nil, errors.New("retention requires a database path")
+	}
+
+	done := make(chan struct{})
+
+	interval := policy.Interval
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			enforceRetention(policy)
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }, nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	defaultCorridorWidth = 0.5
+	kilometersPerDegree  = 111.32
+)
+
+type routeRequest struct {
+	Path     []geoData `json:"path"`
+	Stations []string  `json:"stations"`
+	Width    float64   `json:"width"`
+}
+
+type corridor struct {
+	path  []geoData
+	width float64
+}
+
+func loadStations(filename string) (map[string]geoData, error) {
+	stations := make(map[string]geoData)
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return stations, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(&stations); err != nil {
+		return nil, err
+	}
+
+	return stations, nil
+}
+
+func newCorridor(request routeRequest) (*corridor, error) {
+	c := &corridor{width: request.Width}
+	if c.width <= 0 {
+		c.width = defaultCorridorWidth
+	}
+
+	switch {
+	case len(request.Path) > 0:
+		c.path = request.Path
+	case len(request.Stations) > 0:
+		for _, name := range request.Stations {
+			stn, ok := stationGeo[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown station %s", name)
+			}
+
+			c.path = append(c.path, stn)
+		}
+	}
+
+	if len(c.path) < 2 {
+		return nil, errors.New("route requires at least two points")
+	}
+
+	return c, nil
+}
+
+// distance returns the perpendicular distance in kilometers from a point to
+// the closest segment of the corridor path, using a local planar projection.
+func (c *corridor) distance(point geoData) float64 {
+	lngScale := kilometersPerDegree * math.Cos(point.Latitude*math.Pi/180)
+
+	project := func(p geoData) (x, y float64) {
+		return (p.Longitude - point.Longitude) * lngScale, (p.Latitude - point.Latitude) * kilometersPerDegree
+	}
+
+	minDist := math.MaxFloat64
+	for i := 1; i < len(c.path); i++ {
+		x1, y1 := project(c.path[i-1])
+		x2, y2 := project(c.path[i])
+
+		dx, dy := x2-x1, y2-y1
+
+		var t float64
+		if length := dx*dx + dy*dy; length > 0 {
+			t = math.Max(0, math.Min(1, -(x1*dx+y1*dy)/length))
+		}
+
+		minDist = math.Min(minDist, math.Hypot(x1+t*dx, y1+t*dy))
+	}
+
+	return minDist
+}
+
+func filterByCorridor(entries []record, c *corridor) []record {
+	var filtered []record
+	for _, entry := range entries {
+		if entry.DistanceToRoute <= c.width {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered
+}
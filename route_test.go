@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCorridorDistance(t *testing.T) {
+	var (
+		straight = []geoData{{0, 0}, {0, 1}}
+		bent     = []geoData{{0, 0}, {0, 1}, {1, 1}}
+	)
+
+	tests := []struct {
+		name  string
+		path  []geoData
+		point geoData
+		want  float64
+	}{
+		{"on path", straight, geoData{0, 0.5}, 0},
+		{"at vertex", straight, geoData{0, 1}, 0},
+		{"beside segment", straight, geoData{0.01, 0.5}, 0.01 * kilometersPerDegree},
+		{"past end", straight, geoData{0, 1.5}, 0.5 * kilometersPerDegree},
+		{"before start", straight, geoData{-0.03, -0.04}, math.Hypot(0.03, 0.04*math.Cos(-0.03*math.Pi/180)) * kilometersPerDegree},
+		{"closest to second segment", bent, geoData{0.5, 1.01}, 0.01 * kilometersPerDegree * math.Cos(0.5*math.Pi/180)},
+		{"degenerate segment", []geoData{{0, 0}, {0, 0}}, geoData{0.01, 0}, 0.01 * kilometersPerDegree},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &corridor{path: test.path, width: defaultCorridorWidth}
+			if got := c.distance(test.point); math.Abs(got-test.want) > 1e-6 {
+				t.Errorf("distance(%v) = %v, want %v", test.point, got, test.want)
+			}
+		})
+	}
+}
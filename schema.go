@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// tableColumns maps the column names of table to their declared types; the
+// result is empty when the table does not exist.
+func tableColumns(ctx context.Context, db *sql.DB, table string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var (
+			cid, notNull, primaryKey int
+			name, columnType         string
+			defaultValue             sql.NullString
+		)
+
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return nil, err
+		}
+
+		columns[name] = columnType
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return columns, nil
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	columns, err := tableColumns(context.Background(), db, table)
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := columns[column]
+	return ok, nil
+}
+
+func addColumn(db *sql.DB, table, column, definition string) error {
+	exists, err := columnExists(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func upgradeSchema(db *sql.DB) error {
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"history", "userId", "VARCHAR(100) NOT NULL DEFAULT ''"},
+		{"history", "event", "VARCHAR(20) NOT NULL DEFAULT 'access'"},
+		{"history", "eventValue", "FLOAT NOT NULL DEFAULT 0"},
+		{"categories", "userId", "VARCHAR(100) NOT NULL DEFAULT ''"},
+		{"categories", "displayOrder", "INTEGER NOT NULL DEFAULT 0"},
+		{"categories", "section", "VARCHAR(100) NOT NULL DEFAULT ''"},
+		{"categories", "archived", "INTEGER NOT NULL DEFAULT 0"},
+		{"categories", "type", "VARCHAR(20) NOT NULL DEFAULT 'scale'"},
+		{"categories", "options", "TEXT NOT NULL DEFAULT '[]'"},
+		{"categories", "minValue", "FLOAT NOT NULL DEFAULT -1"},
+		{"categories", "maxValue", "FLOAT NOT NULL DEFAULT 1"},
+	}
+
+	for _, c := range columns {
+		if err := addColumn(db, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	// Categories without an owner used to be shared implicitly; flag them
+	// explicitly the first time the column is added.
+	shared, err := columnExists(db, "categories", "shared")
+	if err != nil {
+		return err
+	}
+
+	if !shared {
+		_, err := db.Exec(`
+			ALTER TABLE categories ADD COLUMN shared INTEGER NOT NULL DEFAULT 0;
+			UPDATE categories SET shared = 1 WHERE userId = ''`)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM historyGroups WHERE categoryId NOT IN (SELECT id FROM categories);
+		DELETE FROM historyGroups WHERE historyId NOT IN (SELECT id FROM history)`)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS sources(
+			reviewId INTEGER NOT NULL,
+			url VARCHAR(400) NOT NULL,
+			count INTEGER NOT NULL,
+			features TEXT NOT NULL,
+			FOREIGN KEY(reviewId) REFERENCES reviews(id) ON DELETE CASCADE);
+		CREATE TABLE IF NOT EXISTS cfNeighbors(
+			reviewId INTEGER NOT NULL,
+			neighborId INTEGER NOT NULL,
+			similarity FLOAT NOT NULL,
+			builtAt DATETIME NOT NULL,
+			FOREIGN KEY(reviewId) REFERENCES reviews(id),
+			FOREIGN KEY(neighborId) REFERENCES reviews(id))`)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS profiles(
+			name VARCHAR(200) NOT NULL,
+			userId VARCHAR(100) NOT NULL DEFAULT '',
+			updated DATETIME NOT NULL,
+			id INTEGER PRIMARY KEY);
+		CREATE TABLE IF NOT EXISTS profileValues(
+			profileId INTEGER NOT NULL,
+			categoryId INTEGER NOT NULL,
+			value FLOAT NOT NULL,
+			FOREIGN KEY(profileId) REFERENCES profiles(id) ON DELETE CASCADE,
+			FOREIGN KEY(categoryId) REFERENCES categories(id) ON DELETE CASCADE)`)
+
+	if err != nil {
+		return err
+	}
+
+	// History and profiles recorded without an identity belong to a reserved
+	// owner that no request can act as.
+	if _, err := db.Exec("UPDATE history SET userId = (?) WHERE userId = ''", legacyUser); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("UPDATE profiles SET userId = (?) WHERE userId = ''", legacyUser); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS historyUserIndex ON history(userId);
+		CREATE INDEX IF NOT EXISTS historyReviewIndex ON history(reviewId);
+		CREATE INDEX IF NOT EXISTS historyGroupsHistoryIndex ON historyGroups(historyId);
+		CREATE INDEX IF NOT EXISTS sourcesReviewIndex ON sources(reviewId)`)
+
+	return err
+}
@@ -23,14 +23,15 @@
 package search
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"net/http"
-	"path"
-	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -39,44 +40,77 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var dataSrc string
+const (
+	reservedUserPrefix = "~"
+	legacyUser         = reservedUserPrefix + "legacy"
+)
 
-func handleExecuteQuery(rw http.ResponseWriter, req *http.Request) {
-	startTime := time.Now()
+var (
+	adminToken string
+	dataSrc    string
+	namedAreas map[string]*geoArea
+	stationGeo map[string]geoData
+)
 
-	db, err := sql.Open("sqlite3", dataSrc)
-	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+func openDatabase() (*sql.DB, error) {
+	return openDatabaseAt(dataSrc)
+}
+
+func openDatabaseAt(dataPath string) (*sql.DB, error) {
+	return sql.Open("sqlite3", dataPath+"?_foreign_keys=1")
+}
+
+// requestUser returns the identity sent with req, or an empty string for
+// anonymous requests; ids starting with reservedUserPrefix are treated as
+// anonymous so that clients cannot act as internal owners.
+func requestUser(req *http.Request) string {
+	user := req.Header.Get("X-User-Id")
+	if len(user) == 0 {
+		user = req.URL.Query().Get("user")
 	}
-	defer db.Close()
 
-	var (
-		request struct {
-			Features    map[string]float64 `json:"features"`
-			Geo         *geoData           `json:"geo"`
-			MaxResults  int                `json:"maxResults"`
-			MinScore    float64            `json:"minScore"`
-			Modes       map[string]string  `json:"modes"`
-			Profile     map[string]float64 `json:"profile"`
-			Resolution  int                `json:"resolution"`
-			SortAsc     bool               `json:"sortAsc"`
-			SortKey     string             `json:"sortKey"`
-			WalkingDist float64            `json:"walkingDist"`
-		}
+	if strings.HasPrefix(user, reservedUserPrefix) {
+		return ""
+	}
 
-		response struct {
-			Columns     map[string]*column `json:"columns"`
-			Count       int                `json:"count"`
-			MinScore    float64            `json:"minScore"`
-			Records     []record           `json:"records"`
-			ElapsedTime int64              `json:"elapsedTime"`
-		}
-	)
+	return user
+}
 
-	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+// invalidQueryError marks query failures caused by the request itself, which
+// handlers report as bad requests rather than server errors.
+type invalidQueryError struct {
+	err error
+}
+
+func (e invalidQueryError) Error() string {
+	return e.err.Error()
+}
+
+func queryErrorStatus(err error) int {
+	var invalid invalidQueryError
+	if errors.As(err, &invalid) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// hasArea reports whether an area was supplied, treating null and blank
+// values the same as a missing one.
+func hasArea(area json.RawMessage) bool {
+	var text string
+	if err := json.Unmarshal(area, &text); err == nil {
+		return len(strings.TrimSpace(text)) > 0
+	}
+
+	trimmed := strings.TrimSpace(string(area))
+	return len(trimmed) > 0 && trimmed != "null"
+}
+
+func executeQuery(ctx context.Context, db *sql.DB, user string, request queryRequest) (*queryResult, error) {
+	profile, err := resolveProfile(db, user, request.ProfileId, request.Profile)
+	if err != nil {
+		return nil, err
 	}
 
 	var geo *geoData
@@ -84,24 +118,155 @@ func handleExecuteQuery(rw http.ResponseWriter, req *http.Request) {
 		geo = &geoData{request.Geo.Latitude, request.Geo.Longitude}
 	}
 
-	allEntries, err := fetchRecords(db, queryContext{geo, request.Profile, request.WalkingDist})
+	var route *corridor
+	if request.Route != nil {
+		if route, err = newCorridor(*request.Route); err != nil {
+			return nil, invalidQueryError{err}
+		}
+	}
+
+	model := request.cfModel
+	if model == nil {
+		model = currentCFModel()
+	}
+
+	qc := queryContext{
+		ctx:           ctx,
+		cf:            model,
+		cfWeight:      request.CfWeight,
+		compatPrior:   request.CompatPrior,
+		decay:         request.Decay,
+		eventWeights:  request.EventWeights,
+		geo:           geo,
+		historyBefore: request.historyBefore,
+		historyBlend:  request.HistoryBlend,
+		profile:       profile,
+		route:         route,
+		user:          user,
+		walkingDist:   request.WalkingDist,
+	}
+
+	fetchStart := time.Now()
+
+	allEntries, err := fetchRecords(db, qc)
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
+	if route != nil {
+		allEntries = filterByCorridor(allEntries, route)
+	}
+
+	if areaName := strings.TrimSpace(request.AreaName); len(areaName) > 0 {
+		area, ok := namedAreas[areaName]
+		if !ok {
+			return nil, invalidQueryError{fmt.Errorf("unknown area %q", areaName)}
+		}
+
+		allEntries = filterByArea(allEntries, area)
+	}
+
+	if hasArea(request.Area) {
+		area, err := parseArea(request.Area)
+		if err != nil {
+			return nil, invalidQueryError{fmt.Errorf("invalid area: %v", err)}
+		}
+
+		allEntries = filterByArea(allEntries, area)
+	}
+
+	fetchTime := observeStage("fetch", fetchStart)
+
 	features := fixFeatures(request.Features)
 	modes := fixModes(request.Modes)
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	scoringStart := time.Now()
+
 	matchedEntries := findRecords(allEntries, features, modes, request.MinScore)
 	sorter := recordSorter{entries: matchedEntries, key: request.SortKey, ascending: request.SortAsc}
 	sorter.sort()
 
+	scoringTime := observeStage("scoring", scoringStart)
+	queryMatchedRecords.observe("", float64(len(matchedEntries)))
+
+	if timings := queryTimingsFrom(ctx); timings != nil {
+		timings.fetch = fetchTime
+		timings.scoring = scoringTime
+	}
+
+	return &queryResult{allEntries, matchedEntries, features, modes}, nil
+}
+
+// summary lists the query parameters worth recording in the access log,
+// leaving out bulky values such as areas and feature vectors.
+func (q queryRequest) summary() []interface{} {
+	features := make([]string, 0, len(q.Features))
+	for name := range q.Features {
+		features = append(features, name)
+	}
+	sort.Strings(features)
+
+	return []interface{}{
+		"features", strings.Join(features, ","),
+		"profileSize", len(q.Profile),
+		"profileId", q.ProfileId,
+		"areaName", q.AreaName,
+		"hasArea", hasArea(q.Area),
+		"hasGeo", q.Geo != nil,
+		"hasRoute", q.Route != nil,
+		"walkingDist", q.WalkingDist,
+		"minScore", q.MinScore,
+		"maxResults", q.MaxResults,
+		"resolution", q.Resolution,
+		"sortKey", q.SortKey,
+	}
+}
+
+func handleExecuteQuery(rw http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		request  queryRequest
+		response queryResponse
+	)
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, timings := withQueryTimings(req.Context())
+	user := requestUser(req)
+
+	// The summary is attached before any work so that failed queries, which
+	// most need it, are logged with their parameters too.
+	logFields(ctx, request.summary()...)
+	logDebug("query request", "requestId", requestId(ctx), "user", user, "request", request)
+
+	result, err := executeQuery(ctx, db, user, request)
+	if err != nil {
+		http.Error(rw, err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	projectionStart := time.Now()
+
 	var wg sync.WaitGroup
-	wg.Add(len(features))
+	wg.Add(len(result.features))
 
 	response.Columns = make(map[string]*column)
-	for name := range features {
+	for name := range result.features {
 		response.Columns[name] = new(column)
 
 		go func(name string) {
@@ -110,13 +275,13 @@ func handleExecuteQuery(rw http.ResponseWriter, req *http.Request) {
 			col := response.Columns[name]
 
 			col.Bracket = bracket{Max: -1.0, Min: 1.0}
-			col.Hints = project(allEntries, features, modes, name, request.MinScore, request.Resolution)
-			col.Mode = modes[name].String()
+			col.Hints = project(ctx, result.allEntries, result.features, result.modes, name, request.MinScore, request.Resolution)
+			col.Mode = result.modes[name].String()
 			col.Steps = request.Resolution
-			col.Value = features[name]
+			col.Value = result.features[name]
 
 			var d stats.Stats
-			for _, record := range matchedEntries {
+			for _, record := range result.matchedEntries {
 				if feature, ok := record.features[name]; ok {
 					d.Update(feature)
 				}
@@ -138,14 +303,31 @@ func handleExecuteQuery(rw http.ResponseWriter, req *http.Request) {
 
 	wg.Wait()
 
-	response.Count = len(matchedEntries)
+	if err := ctx.Err(); err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	timings.projection = observeStage("projection", projectionStart)
+
+	response.Count = len(result.matchedEntries)
+	response.Decay = request.Decay
 	response.MinScore = request.MinScore
 	response.ElapsedTime = time.Since(startTime).Nanoseconds()
 
-	if len(matchedEntries) > request.MaxResults {
-		response.Records = matchedEntries[:request.MaxResults]
+	logFields(
+		ctx,
+		"matched", response.Count,
+		"dbMs", timings.db,
+		"fetchMs", timings.fetch,
+		"scoringMs", timings.scoring,
+		"projectionMs", timings.projection,
+	)
+
+	if len(result.matchedEntries) > request.MaxResults {
+		response.Records = result.matchedEntries[:request.MaxResults]
 	} else {
-		response.Records = matchedEntries
+		response.Records = result.matchedEntries
 	}
 
 	js, err := json.Marshal(response)
@@ -158,143 +340,176 @@ func handleExecuteQuery(rw http.ResponseWriter, req *http.Request) {
 	rw.Write(js)
 }
 
-func handleGetCategories(rw http.ResponseWriter, req *http.Request) {
-	db, err := sql.Open("sqlite3", dataSrc)
+func handleGetClusters(rw http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+
+	db, err := openDatabase()
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
 
-	categoryRows, err := db.Query("SELECT description, id FROM categories")
+	var (
+		request  clusterRequest
+		response clusterResponse
+	)
+
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := executeQuery(req.Context(), db, requestUser(req), request.queryRequest)
+	if err != nil {
+		http.Error(rw, err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	response.Clusters = clusterRecords(result.matchedEntries, request.Bounds, request.Zoom)
+	response.Count = len(result.matchedEntries)
+	response.ElapsedTime = time.Since(startTime).Nanoseconds()
+
+	js, err := json.Marshal(response)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer categoryRows.Close()
 
-	type category struct {
-		Description string `json:"description"`
-		Id          int    `json:"id"`
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleExportQuery(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	defer db.Close()
 
-	var response []category
-	for categoryRows.Next() {
-		var (
-			description string
-			id          int
-		)
+	var request exportRequest
 
-		if err := categoryRows.Scan(&description, &id); err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		response = append(response, category{description, id})
+	if len(request.Format) == 0 {
+		request.Format = defaultExportFormat
 	}
 
-	if err := categoryRows.Err(); err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	format, ok := exportFormats[request.Format]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("unsupported export format %q", request.Format), http.StatusBadRequest)
 		return
 	}
 
-	js, err := json.Marshal(response)
+	result, err := executeQuery(req.Context(), db, requestUser(req), request.queryRequest)
+	if err != nil {
+		http.Error(rw, err.Error(), queryErrorStatus(err))
+		return
+	}
+
+	entries := result.matchedEntries
+	if request.MaxResults > 0 && len(entries) > request.MaxResults {
+		entries = entries[:request.MaxResults]
+	}
+
+	data, err := format.encode(entries)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	rw.Header().Set("Content-Type", "application/json")
-	rw.Write(js)
+	rw.Header().Set("Content-Type", format.contentType)
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=results.%s", format.extension))
+	rw.Write(data)
 }
 
-func handleAddCategory(rw http.ResponseWriter, req *http.Request) {
-	db, err := sql.Open("sqlite3", dataSrc)
+func handleAccessReview(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
 
-	var (
-		request struct {
-			Description string `json:"description"`
-		}
-
-		response struct {
-			Description string `json:"description"`
-			Id          int    `json:"id"`
-			Success     bool   `json:"success"`
-		}
-	)
+	var request accessRequest
 
 	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	response.Description = strings.TrimSpace(request.Description)
+	user := requestUser(req)
 
-	if len(response.Description) > 0 {
-		result, err := db.Exec("INSERT INTO categories(description) VALUES(?)", request.Description)
-		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	profile, err := resolveProfile(db, user, request.ProfileId, request.Profile)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		insertId, err := result.LastInsertId()
-		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	specs, err := loadCategorySpecs(db, user)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		rows, err := result.RowsAffected()
-		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if err := validateProfile(specs, profile); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		response.Success = rows > 0
-		response.Id = int(insertId)
+	reviewsResult, err := db.Exec("UPDATE reviews SET accessCount = accessCount + 1 WHERE id = (?)", request.Id)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	js, err := json.Marshal(response)
+	rowsAffected, err := reviewsResult.RowsAffected()
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	rw.Header().Set("Content-Type", "application/json")
-	rw.Write(js)
+	if rowsAffected == 0 || len(profile) == 0 {
+		http.Error(rw, "invalid profile", http.StatusInternalServerError)
+		return
+	}
+
+	if err := recordHistory(db, specs, user, request.Id, historyEventAccess, 0, profile); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
-func handleRemoveCategory(rw http.ResponseWriter, req *http.Request) {
-	db, err := sql.Open("sqlite3", dataSrc)
+func handleRecommend(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
 
-	var (
-		request struct {
-			Id int `json:"id"`
+	limit := defaultRecommendLimit
+	if value := req.URL.Query().Get("limit"); len(value) > 0 {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			http.Error(rw, fmt.Sprintf("invalid limit %q", value), http.StatusBadRequest)
+			return
 		}
+	}
 
-		response struct {
-			Success bool `json:"success"`
-		}
-	)
+	if limit > maxRecommendLimit {
+		limit = maxRecommendLimit
+	}
 
-	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+	response, err := recommendRecords(req.Context(), db, requestUser(req), limit)
+	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if _, err := db.Exec("DELETE FROM categories WHERE id = (?)", request.Id); err == nil {
-		response.Success = true
-	}
-
 	js, err := json.Marshal(response)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -305,87 +520,88 @@ func handleRemoveCategory(rw http.ResponseWriter, req *http.Request) {
 	rw.Write(js)
 }
 
-func handleAccessReview(rw http.ResponseWriter, req *http.Request) {
-	db, err := sql.Open("sqlite3", dataSrc)
+func handleSuggest(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
 
-	var request struct {
-		Id      int                `json:"id"`
-		Profile map[string]float64 `json:"profile"`
-	}
-
-	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+	response, err := suggestFeatures(db, requestUser(req))
+	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	reviewsResult, err := db.Exec("UPDATE reviews SET accessCount = accessCount + 1 WHERE id = (?)", request.Id)
+	js, err := json.Marshal(response)
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	rowsAffected, err := reviewsResult.RowsAffected()
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func handleRefreshCF(rw http.ResponseWriter, req *http.Request) {
+	db, err := openDatabase()
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer db.Close()
 
-	if rowsAffected == 0 || len(request.Profile) == 0 {
-		http.Error(rw, "invalid profile", http.StatusInternalServerError)
+	model, err := buildCFModel(db, math.MaxInt64)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	historyResult, err := db.Exec("INSERT INTO history(date, reviewId) VALUES(DATETIME('now'), ?)", request.Id)
-	if err != nil {
+	if err := saveCFModel(db, model); err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	insertId, err := historyResult.LastInsertId()
+	setCFModel(model)
+
+	js, err := json.Marshal(model.stats())
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	for id, value := range request.Profile {
-		catRow := db.QueryRow("SELECT EXISTS(SELECT NULL FROM categories WHERE id = ?)", id)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
 
-		var catExists int
-		if err := catRow.Scan(&catExists); err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
+func handleGetAreas(rw http.ResponseWriter, req *http.Request) {
+	response := make([]string, 0, len(namedAreas))
+	for name := range namedAreas {
+		response = append(response, name)
+	}
 
-		if catExists == 0 {
-			continue
-		}
+	sort.Strings(response)
 
-		if _, err := db.Exec("INSERT INTO historyGroups(categoryId, categoryValue, historyId) VALUES(?, ?, ?)", id, value, insertId); err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	js, err := json.Marshal(response)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
 }
 
 func handleClearHistory(rw http.ResponseWriter, req *http.Request) {
-	db, err := sql.Open("sqlite3", dataSrc)
+	db, err := openDatabase()
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
 
-	if _, err := db.Exec("DELETE FROM historyGroups"); err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if _, err := db.Exec("DELETE FROM history"); err != nil {
+	if _, err := deleteHistory(db, "history.userId = (?)", requestUser(req)); err != nil {
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -394,39 +610,62 @@ func handleClearHistory(rw http.ResponseWriter, req *http.Request) {
 	fmt.Fprint(rw, "History tables cleared")
 }
 
-func queryPaths() (staticDat, dataSrc string, err error) {
-	_, filename, _, ok := runtime.Caller(1)
-	if !ok {
-		err = errors.New("unable to capture paths")
-		return
+func NewSearchApp(options Options) (http.Handler, error) {
+	if err := options.resolve(); err != nil {
+		return nil, err
 	}
 
-	dir := path.Dir(filename)
+	if err := configureLogging(options); err != nil {
+		return nil, err
+	}
 
-	dataSrc = path.Join(dir, "build/data/db.sqlite3")
-	staticDat = path.Join(dir, "static")
-	return
-}
+	dataSrc = options.DataPath
+	adminToken = options.AdminToken
 
-func NewSearchApp() (*http.ServeMux, error) {
-	var (
-		err       error
-		staticDat string
-	)
+	defaultFeatures = options.Features
+	defaultModes = make(map[string]modeType)
+	for name, value := range options.Modes {
+		defaultModes[name], _ = parseModeType(value)
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := upgradeSchema(db); err != nil {
+		return nil, err
+	}
+
+	model, err := loadCFModel(db)
+	if err != nil {
+		return nil, err
+	}
+
+	setCFModel(model)
+
+	namedAreas, err = loadAreas(options.AreasPath)
+	if err != nil {
+		return nil, err
+	}
 
-	staticDat, dataSrc, err = queryPaths()
+	stationGeo, err = loadStations(options.StationsPath)
 	if err != nil {
 		return nil, err
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/query", handleExecuteQuery)
-	mux.HandleFunc("/categories", handleGetCategories)
-	mux.HandleFunc("/learn", handleAddCategory)
-	mux.HandleFunc("/forget", handleRemoveCategory)
-	mux.HandleFunc("/access", handleAccessReview)
-	mux.HandleFunc("/clear", handleClearHistory)
-	mux.Handle("/", http.FileServer(http.Dir(staticDat)))
-
-	return mux, nil
+	if err := registerAPI(mux); err != nil {
+		return nil, err
+	}
+
+	static, err := staticHandler(options.StaticPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mux.Handle("/", instrument("/", static))
+
+	return logRequests(mux), nil
 }
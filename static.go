@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+var assetRefExp = regexp.MustCompile(`(src|href)="([^"]+)"`)
+
+type asset struct {
+	data []byte
+	hash string
+}
+
+// assetServer serves a fixed file tree from memory. Local script, style and
+// image references in HTML pages are rewritten to carry a content hash so
+// that versioned URLs can be cached indefinitely by the browser.
+type assetServer struct {
+	assets map[string]asset
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+func newAssetServer(files fs.FS) (*assetServer, error) {
+	s := &assetServer{assets: make(map[string]asset)}
+
+	var pages []string
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+
+		name = "/" + name
+		s.assets[name] = asset{data, contentHash(data)}
+
+		if path.Ext(name) == ".html" {
+			pages = append(pages, name)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range pages {
+		data := assetRefExp.ReplaceAllFunc(s.assets[name].data, func(match []byte) []byte {
+			parts := assetRefExp.FindSubmatch(match)
+
+			ref := string(parts[2])
+			if strings.Contains(ref, ":") || strings.HasPrefix(ref, "/") || strings.ContainsAny(ref, "?#") {
+				return match
+			}
+
+			target, ok := s.assets[path.Join(path.Dir(name), ref)]
+			if !ok {
+				return match
+			}
+
+			return []byte(string(parts[1]) + `="` + ref + "?v=" + target.hash + `"`)
+		})
+
+		s.assets[name] = asset{data, contentHash(data)}
+	}
+
+	return s, nil
+}
+
+func (s *assetServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	name := path.Clean(req.URL.Path)
+	if strings.HasSuffix(req.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	a, ok := s.assets[name]
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+
+	rw.Header().Set("ETag", `"`+a.hash+`"`)
+	if req.URL.Query().Get("v") == a.hash {
+		rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		rw.Header().Set("Cache-Control", "no-cache")
+	}
+
+	http.ServeContent(rw, req, name, time.Time{}, bytes.NewReader(a.data))
+}
+
+func staticHandler(dir string) (http.Handler, error) {
+	if len(dir) > 0 {
+		files := http.FileServer(http.Dir(dir))
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Cache-Control", "no-cache")
+			files.ServeHTTP(rw, req)
+		}), nil
+	}
+
+	files, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		return nil, err
+	}
+
+	return newAssetServer(files)
+}
@@ -31,36 +31,57 @@
 
     function getProfileValue(id) {
         var profile = JSON.parse(localStorage.profile || '{}');
-        return profile[id] || 0;
+        return _.has(profile, id) ? profile[id] : null;
+    }
+
+    function makeCategory(result) {
+        var category = {
+            id:          result.id,
+            description: result.description,
+            type:        result.type,
+            options:     result.options,
+            value:       getProfileValue(result.id)
+        };
+
+        if (result.type === 'scale') {
+            category.agree    = result.range.max;
+            category.disagree = result.range.min;
+            category.neither  = (result.range.min + result.range.max) / 2;
+
+            if (category.value === null) {
+                category.value = category.neither;
+            }
+        }
+
+        return category;
     }
 
     function addCategory(description) {
-        $.post('/learn', JSON.stringify({description: description}), function(results) {
+        $.post('/api/v1/categories', JSON.stringify({description: description}), function(results) {
             if (!results.success) {
                 return;
             }
 
-            var categories = [{
-                id:          results.id,
-                value:       getProfileValue(results.id),
-                description: results.description
-            }];
-
-            displayCategories(categories);
+            displayCategories([makeCategory(results)]);
         }, 'json');
     }
 
     function removeCategory(id) {
-        $.post('/forget', JSON.stringify({id: id}), function(results) {
-            if (results.success) {
-                $('tr.category_' + id).fadeOut(function() {
-                    $(this).remove();
-                });
-            }
-            else {
-                alert('Category could not be deleted because it is referenced by user access history.');
+        $.ajax({
+            url:      '/api/v1/categories/' + id,
+            type:     'DELETE',
+            dataType: 'json',
+            success:  function(results) {
+                if (results.success) {
+                    $('tr.category_' + id).fadeOut(function() {
+                        $(this).remove();
+                    });
+                }
+                else {
+                    alert('Category could not be deleted.');
+                }
             }
-        }, 'json');
+        });
     }
 
     function displayCategories(categories) {
@@ -68,7 +89,7 @@
         $('#categories').append($(template({categories: categories})).hide().fadeIn());
 
         $('#categories input:radio').unbind().change(function() {
-            setProfileValue($(this).attr('data-categoryId'), parseInt(this.value));
+            setProfileValue($(this).attr('data-categoryId'), parseFloat(this.value));
         });
 
         $('#categories button').unbind().click(function() {
@@ -81,15 +102,11 @@
     }
 
     function refreshCategories() {
-        $.get('/categories', function(results) {
+        $.get('/api/v1/categories', function(results) {
             var categories = [];
 
             _.each(results, function(result) {
-                categories.push({
-                    id:          result.id,
-                    description: result.description,
-                    value:       getProfileValue(result.id)
-                });
+                categories.push(makeCategory(result));
             });
 
             clearCategories();
@@ -104,7 +121,15 @@
 
     $(document).ready(function() {
         Handlebars.registerHelper('checkMatch', function(value, options) {
-            return new Handlebars.SafeString(value == this.value ? 'checked' : '');
+            return new Handlebars.SafeString(value === this.value ? 'checked' : '');
+        });
+
+        Handlebars.registerHelper('checkOption', function(value, current, options) {
+            return new Handlebars.SafeString(value === current ? 'checked' : '');
+        });
+
+        Handlebars.registerHelper('ifType', function(type, options) {
+            return this.type === type ? options.fn(this) : options.inverse(this);
         });
 
         refreshCategories();
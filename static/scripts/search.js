@@ -29,7 +29,7 @@
         _ctx.query.features[name] = value;
         _ctx.query.modes[name]    = mode;
 
-        $.post('/query', JSON.stringify(_ctx.query), function(results) {
+        $.post('/api/v1/query', JSON.stringify(_ctx.query), function(results) {
             saveSnapshot(results);
             outputSnapshot(results, true);
         }, 'json');
@@ -90,7 +90,7 @@
                 setter();
             }
 
-            $.post('/access', JSON.stringify({id: id, profile: getProfile()}));
+            $.post('/api/v1/access', JSON.stringify({id: id, profile: getProfile()}));
         };
 
         window.sortReviewsBy = function(sortKey) {
@@ -127,7 +127,7 @@
             };
         }
 
-        $.post('/query', JSON.stringify(_ctx.query), function(results) {
+        $.post('/api/v1/query', JSON.stringify(_ctx.query), function(results) {
             if (!_.has(_ctx, 'grapher')) {
                 _ctx.grapher = new grapher.Grapher({
                     canvas:        new Snap('#svg'),
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"database/sql"
+	"math"
+)
+
+const (
+	suggestEvidencePrior  = 5.0
+	suggestDistanceSpread = 0.2
+	suggestFeatureCount   = 4
+)
+
+var suggestFeatureNames = [suggestFeatureCount]string{"delicious", "accommodating", "affordable", "atmospheric"}
+
+type suggestion struct {
+	Confidence  float64            `json:"confidence"`
+	Confidences map[string]float64 `json:"confidences"`
+	Count       int                `json:"count"`
+	Features    map[string]float64 `json:"features"`
+	Modes       map[string]string  `json:"modes"`
+}
+
+// suggestFeatures fits the weighted mean feature vector of the restaurants a
+// user has positively interacted with. Features with a narrow spread around
+// the mean are suggested in distance mode, the rest in product mode.
+func suggestFeatures(db *sql.DB, user string) (*suggestion, error) {
+	rows, err := db.Query(
+		`SELECT history.event, history.eventValue, reviews.delicious, reviews.accommodating, reviews.affordable, reviews.atmospheric
+		FROM history JOIN reviews ON reviews.id = history.reviewId WHERE history.userId = (?)`,
+		user,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		sums, squares [suggestFeatureCount]float64
+		totalWeight   float64
+		count         int
+	)
+
+	for rows.Next() {
+		var (
+			event      string
+			eventValue float64
+			values     [suggestFeatureCount]float64
+		)
+
+		if err := rows.Scan(&event, &eventValue, &values[0], &values[1], &values[2], &values[3]); err != nil {
+			return nil, err
+		}
+
+		weight := eventWeight(event, eventValue, nil)
+		if weight <= 0 {
+			continue
+		}
+
+		for i, value := range values {
+			sums[i] += weight * value
+			squares[i] += weight * value * value
+		}
+
+		totalWeight += weight
+		count++
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &suggestion{
+		Count:       count,
+		Features:    fixFeatures(nil),
+		Modes:       make(map[string]string),
+		Confidences: make(map[string]float64),
+	}
+
+	for name, mode := range fixModes(nil) {
+		result.Modes[name] = mode.String()
+	}
+
+	if totalWeight == 0 {
+		return result, nil
+	}
+
+	evidence := float64(count) / (float64(count) + suggestEvidencePrior)
+
+	for i, name := range suggestFeatureNames {
+		mean := sums[i] / totalWeight
+		spread := math.Sqrt(math.Max(squares[i]/totalWeight-mean*mean, 0))
+
+		result.Features[name] = mean
+		if spread < suggestDistanceSpread {
+			result.Modes[name] = modeTypeDist.String()
+		}
+
+		result.Confidences[name] = evidence * (1 - math.Min(spread, 1))
+		result.Confidence += result.Confidences[name] / suggestFeatureCount
+	}
+
+	return result, nil
+}
@@ -23,7 +23,10 @@
 package search
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"math"
 	"sort"
 )
 
@@ -34,11 +37,37 @@ const (
 	modeTypeDist
 )
 
+type categoryType int
+
+const (
+	categoryTypeScale categoryType = iota + 1
+	categoryTypeBoolean
+	categoryTypeChoice
+)
+
+type categorySpec struct {
+	kind    categoryType
+	options []string
+	bounds  bracket
+}
+
 type bracket struct {
 	Min float64 `json:"min"`
 	Max float64 `json:"max"`
 }
 
+type category struct {
+	Archived    bool     `json:"archived"`
+	Description string   `json:"description"`
+	Id          int      `json:"id"`
+	Options     []string `json:"options,omitempty"`
+	Order       int      `json:"order"`
+	Range       bracket  `json:"range"`
+	Section     string   `json:"section"`
+	Shared      bool     `json:"shared"`
+	Type        string   `json:"type"`
+}
+
 type column struct {
 	Bracket bracket      `json:"bracket"`
 	Hints   []projection `json:"hints"`
@@ -54,23 +83,110 @@ type projection struct {
 }
 
 type record struct {
-	AccessCount    int     `json:"accessCount"`
-	ClosestStn     string  `json:"closestStn"`
-	Compatibility  float64 `json:"compatibility"`
-	DistanceToStn  float64 `json:"distanceToStn"`
-	DistanceToUser float64 `json:"distanceToUser"`
-	Id             int     `json:"id"`
-	Name           string  `json:"name"`
-	Score          float64 `json:"score"`
-	Address        string  `json:"address"`
-	Geo            geoData `json:"geo"`
+	AccessCount           int     `json:"accessCount"`
+	Cf                    float64 `json:"cf,omitempty"`
+	ClosestStn            string  `json:"closestStn"`
+	Compatibility         float64 `json:"compatibility"`
+	CompatibilityCount    int     `json:"compatibilityCount"`
+	CompatibilityMargin   float64 `json:"compatibilityMargin,omitempty"`
+	CompatibilityVariance float64 `json:"compatibilityVariance"`
+	DistanceToStn         float64 `json:"distanceToStn"`
+	DistanceToUser        float64 `json:"distanceToUser"`
+	DistanceToRoute       float64 `json:"distanceToRoute,omitempty"`
+	Id                    int     `json:"id"`
+	Name                  string  `json:"name"`
+	Score                 float64 `json:"score"`
+	Address               string  `json:"address"`
+	Geo                   geoData `json:"geo"`
+	bias                  float64
+	features              map[string]float64
+}
+
+// compatStats accumulates weighted compatibility samples from history.
+type compatStats struct {
+	count         int
+	sum           float64
+	squares       float64
+	weight        float64
+	weightSquares float64
+}
+
+type recommendation struct {
+	Address string  `json:"address"`
+	Geo     geoData `json:"geo"`
+	Id      int     `json:"id"`
+	Name    string  `json:"name"`
+	Score   float64 `json:"score"`
+}
+
+type decayParams struct {
+	HalfLife float64 `json:"halfLife"`
+}
+
+type queryRequest struct {
+	Area          json.RawMessage    `json:"area"`
+	AreaName      string             `json:"areaName"`
+	CfWeight      float64            `json:"cfWeight"`
+	CompatPrior   float64            `json:"compatPrior"`
+	Decay         *decayParams       `json:"decay"`
+	EventWeights  map[string]float64 `json:"eventWeights"`
+	Features      map[string]float64 `json:"features"`
+	Geo           *geoData           `json:"geo"`
+	HistoryBlend  float64            `json:"historyBlend"`
+	MaxResults    int                `json:"maxResults"`
+	MinScore      float64            `json:"minScore"`
+	Modes         map[string]string  `json:"modes"`
+	Profile       map[string]float64 `json:"profile"`
+	ProfileId     int                `json:"profileId"`
+	Resolution    int                `json:"resolution"`
+	Route         *routeRequest      `json:"route"`
+	SortAsc       bool               `json:"sortAsc"`
+	SortKey       string             `json:"sortKey"`
+	WalkingDist   float64            `json:"walkingDist"`
+	cfModel       *cfModel
+	historyBefore int
+}
+
+type queryResponse struct {
+	Columns     map[string]*column `json:"columns"`
+	Count       int                `json:"count"`
+	Decay       *decayParams       `json:"decay,omitempty"`
+	MinScore    float64            `json:"minScore"`
+	Records     []record           `json:"records"`
+	ElapsedTime int64              `json:"elapsedTime"`
+}
+
+type accessRequest struct {
+	Id        int                `json:"id"`
+	Profile   map[string]float64 `json:"profile"`
+	ProfileId int                `json:"profileId"`
+}
+
+type successResponse struct {
+	Success bool `json:"success"`
+}
+
+type queryResult struct {
+	allEntries     []record
+	matchedEntries []record
 	features       map[string]float64
+	modes          map[string]modeType
 }
 
 type queryContext struct {
-	geo         *geoData
-	profile     map[string]float64
-	walkingDist float64
+	ctx           context.Context
+	cf            *cfModel
+	cfWeight      float64
+	compatPrior   float64
+	decay         *decayParams
+	eventWeights  map[string]float64
+	geo           *geoData
+	historyBefore int
+	historyBlend  float64
+	profile       map[string]float64
+	route         *corridor
+	user          string
+	walkingDist   float64
 }
 
 type geoData struct {
@@ -107,10 +223,14 @@ func (s recordSorter) Less(i, j int) bool {
 		return entry1.ClosestStn < entry2.ClosestStn
 	case "compatibility":
 		return entry1.Compatibility < entry2.Compatibility
+	case "cf":
+		return entry1.Cf < entry2.Cf
 	case "distanceToStn":
 		return entry1.DistanceToStn < entry2.DistanceToStn
 	case "distanceToUser":
 		return entry1.DistanceToUser < entry2.DistanceToUser
+	case "distanceToRoute":
+		return entry1.DistanceToRoute < entry2.DistanceToRoute
 	case "name":
 		return entry1.Name < entry2.Name
 	default:
@@ -122,6 +242,95 @@ func (s recordSorter) Swap(i, j int) {
 	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
 }
 
+// historyCutoff returns the id below which history entries are visible to the
+// query; replayed queries only see the history recorded before them.
+func (c queryContext) historyCutoff() int64 {
+	if c.historyBefore > 0 {
+		return int64(c.historyBefore)
+	}
+
+	return math.MaxInt64
+}
+
+func (c *compatStats) update(sample, weight float64) {
+	if weight <= 0 {
+		return
+	}
+
+	c.count++
+	c.sum += weight * sample
+	c.squares += weight * sample * sample
+	c.weight += weight
+	c.weightSquares += weight * weight
+}
+
+// scaled returns the statistics with every sample weight multiplied by
+// factor; samples given no weight are dropped.
+func (c compatStats) scaled(factor float64) compatStats {
+	if factor <= 0 {
+		return compatStats{}
+	}
+
+	return compatStats{
+		count:         c.count,
+		sum:           c.sum * factor,
+		squares:       c.squares * factor,
+		weight:        c.weight * factor,
+		weightSquares: c.weightSquares * factor * factor,
+	}
+}
+
+// merge pools the samples of other into c.
+func (c *compatStats) merge(other compatStats) {
+	c.count += other.count
+	c.sum += other.sum
+	c.squares += other.squares
+	c.weight += other.weight
+	c.weightSquares += other.weightSquares
+}
+
+// mean returns the weighted mean compatibility, shrunk toward zero by a prior
+// worth the given amount of history weight.
+func (c compatStats) mean(prior float64) float64 {
+	if total := c.weight + math.Max(prior, 0); total > 0 {
+		return c.sum / total
+	}
+
+	return 0
+}
+
+// effective returns the effective sample size of the weighted samples.
+func (c compatStats) effective() float64 {
+	if c.weightSquares == 0 {
+		return 0
+	}
+
+	return c.weight * c.weight / c.weightSquares
+}
+
+// variance returns the unbiased weighted sample variance, which is zero until
+// there is more than one effective sample.
+func (c compatStats) variance() float64 {
+	effective := c.effective()
+	if effective <= 1 {
+		return 0
+	}
+
+	mean := c.sum / c.weight
+	return math.Max(c.squares/c.weight-mean*mean, 0) * effective / (effective - 1)
+}
+
+// margin returns the half-width of an approximate 95% confidence interval
+// around the unshrunk mean, or zero when it cannot be estimated.
+func (c compatStats) margin() float64 {
+	effective := c.effective()
+	if effective <= 1 {
+		return 0
+	}
+
+	return 1.96 * math.Sqrt(c.variance()/effective)
+}
+
 func (m modeType) String() string {
 	switch m {
 	case modeTypeProd:
@@ -133,6 +342,32 @@ func (m modeType) String() string {
 	}
 }
 
+func (c categoryType) String() string {
+	switch c {
+	case categoryTypeScale:
+		return "scale"
+	case categoryTypeBoolean:
+		return "boolean"
+	case categoryTypeChoice:
+		return "choice"
+	default:
+		return ""
+	}
+}
+
+func parseCategoryType(kind string) (categoryType, error) {
+	switch kind {
+	case "scale", "":
+		return categoryTypeScale, nil
+	case "boolean":
+		return categoryTypeBoolean, nil
+	case "choice":
+		return categoryTypeChoice, nil
+	default:
+		return 0, errors.New("invalid category type")
+	}
+}
+
 func parseModeType(mode string) (modeType, error) {
 	switch mode {
 	case "product":
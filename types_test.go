@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2015 Alex Yatskov <alex@foosoft.net>
+ * Author: Alex Yatskov <alex@foosoft.net>
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy of
+ * this software and associated documentation files (the "Software"), to deal in
+ * the Software without restriction, including without limitation the rights to
+ * use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+ * the Software, and to permit persons to whom the Software is furnished to do so,
+ * subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+ * FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+ * COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+ * IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package search
+
+import (
+	"math"
+	"testing"
+)
+
+type compatSample struct {
+	value, weight float64
+}
+
+func buildCompatStats(samples []compatSample) compatStats {
+	var stats compatStats
+	for _, sample := range samples {
+		stats.update(sample.value, sample.weight)
+	}
+
+	return stats
+}
+
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestCompatStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []compatSample
+		prior    float64
+		mean     float64
+		variance float64
+		margin   float64
+	}{
+		{"empty", nil, 0, 0, 0, 0},
+		{"empty with prior", nil, 2, 0, 0, 0},
+		{"single sample", []compatSample{{0.5, 1}}, 0, 0.5, 0, 0},
+		{"zero weight ignored", []compatSample{{0.5, 1}, {-1, 0}}, 0, 0.5, 0, 0},
+		{"shrunk by prior", []compatSample{{1, 1}}, 1, 0.5, 0, 0},
+		{"negative prior ignored", []compatSample{{1, 1}}, -1, 1, 0, 0},
+		{"opposite samples", []compatSample{{1, 1}, {-1, 1}}, 0, 0, 2, 1.96},
+		{"unequal weights", []compatSample{{1, 3}, {0, 1}}, 0, 0.75, 0.5, 1.96 * math.Sqrt(0.5/1.6)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := buildCompatStats(test.samples)
+
+			if mean := stats.mean(test.prior); !approxEqual(mean, test.mean) {
+				t.Errorf("mean = %v, want %v", mean, test.mean)
+			}
+
+			if variance := stats.variance(); !approxEqual(variance, test.variance) {
+				t.Errorf("variance = %v, want %v", variance, test.variance)
+			}
+
+			if margin := stats.margin(); !approxEqual(margin, test.margin) {
+				t.Errorf("margin = %v, want %v", margin, test.margin)
+			}
+		})
+	}
+}
+
+func TestCompatStatsPooling(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   []compatSample
+		others []compatSample
+		factor float64
+		pooled []compatSample
+	}{
+		{"user only", []compatSample{{1, 1}}, nil, 0.5, []compatSample{{1, 1}}},
+		{"others only", nil, []compatSample{{-1, 2}}, 0.5, []compatSample{{-1, 1}}},
+		{"scaled others", []compatSample{{1, 1}, {0.5, 2}}, []compatSample{{-1, 1}, {0, 4}}, 0.25, []compatSample{{1, 1}, {0.5, 2}, {-1, 0.25}, {0, 1}}},
+		{"others dropped", []compatSample{{1, 1}}, []compatSample{{-1, 1}}, 0, []compatSample{{1, 1}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := buildCompatStats(test.user)
+			stats.merge(buildCompatStats(test.others).scaled(test.factor))
+
+			want := buildCompatStats(test.pooled)
+
+			if !approxEqual(stats.sum, want.sum) || !approxEqual(stats.squares, want.squares) ||
+				!approxEqual(stats.weight, want.weight) || !approxEqual(stats.weightSquares, want.weightSquares) {
+				t.Errorf("pooled stats = %+v, want %+v", stats, want)
+			}
+
+			if !approxEqual(stats.variance(), want.variance()) || !approxEqual(stats.margin(), want.margin()) {
+				t.Errorf("variance, margin = %v, %v, want %v, %v", stats.variance(), stats.margin(), want.variance(), want.margin())
+			}
+		})
+	}
+}
@@ -23,9 +23,11 @@
 package search
 
 import (
+	"context"
 	"database/sql"
 	"math"
 	"strconv"
+	"time"
 
 	"github.com/GaryBoone/GoStats/stats"
 	"github.com/kellydunn/golang-geo"
@@ -41,6 +43,10 @@ func fixFeatures(features map[string]float64) map[string]float64 {
 		"atmospheric":   0.0}
 
 	for name := range fixedFeatures {
+		if value, ok := defaultFeatures[name]; ok {
+			fixedFeatures[name] = value
+		}
+
 		if value, ok := features[name]; ok {
 			fixedFeatures[name] = value
 		}
@@ -59,6 +65,10 @@ func fixModes(modes map[string]string) map[string]modeType {
 		"atmospheric":   modeTypeProd}
 
 	for name := range fixedModes {
+		if mode, ok := defaultModes[name]; ok {
+			fixedModes[name] = mode
+		}
+
 		if value, ok := modes[name]; ok {
 			if mode, err := parseModeType(value); err == nil {
 				fixedModes[name] = mode
@@ -69,11 +79,18 @@ func fixModes(modes map[string]string) map[string]modeType {
 	return fixedModes
 }
 
-func semanticSimilarity(features1 map[string]float64, features2 map[string]float64) float64 {
+func semanticSimilarity(features1 map[string]float64, features2 map[string]float64, specs map[string]categorySpec) float64 {
 	var result float64
 
 	for key, value1 := range features1 {
-		if value2, ok := features2[key]; ok {
+		value2, ok := features2[key]
+		if !ok {
+			continue
+		}
+
+		if spec, ok := specs[key]; ok {
+			result += spec.similarity(value1, value2)
+		} else {
 			result += value1 * value2
 		}
 	}
@@ -100,7 +117,7 @@ func semanticCompare(features1 map[string]float64, features2 map[string]float64,
 
 func walkMatches(entries []record, features map[string]float64, modes map[string]modeType, minScore float64, callback func(record, float64)) {
 	for _, entry := range entries {
-		if score := semanticCompare(features, entry.features, modes); score >= minScore {
+		if score := semanticCompare(features, entry.features, modes) + entry.bias; score >= minScore {
 			callback(entry, score)
 		}
 	}
@@ -143,7 +160,9 @@ func findRecords(entries []record, features map[string]float64, modes map[string
 	return matchedEntries
 }
 
-func project(entries []record, features map[string]float64, modes map[string]modeType, featureName string, minScore float64, steps int) []projection {
+// project samples the compatibility of a feature across its range; it stops
+// early and returns nil once ctx is cancelled.
+func project(ctx context.Context, entries []record, features map[string]float64, modes map[string]modeType, featureName string, minScore float64, steps int) []projection {
 	sampleFeatures := make(map[string]float64)
 	for key, value := range features {
 		sampleFeatures[key] = value
@@ -151,6 +170,10 @@ func project(entries []record, features map[string]float64, modes map[string]mod
 
 	var projections []projection
 	stepRange(-1.0, 1.0, steps, func(sample float64) {
+		if ctx.Err() != nil {
+			return
+		}
+
 		sample, sampleFeatures[featureName] = sampleFeatures[featureName], sample
 		compatibility, count := statRecords(entries, sampleFeatures, modes, minScore)
 		sample, sampleFeatures[featureName] = sampleFeatures[featureName], sample
@@ -158,20 +181,28 @@ func project(entries []record, features map[string]float64, modes map[string]mod
 		projections = append(projections, projection{compatibility, count, sample})
 	})
 
+	if ctx.Err() != nil {
+		return nil
+	}
+
 	return projections
 }
 
-func computeRecordGeo(entries []record, context queryContext) {
+func computeRecordGeo(entries []record, qc queryContext) {
 	var dist stats.Stats
 	for index := range entries {
 		entry := &entries[index]
 
-		if context.geo != nil {
-			userPoint := geo.NewPoint(context.geo.Latitude, context.geo.Longitude)
-			entryPoint := geo.NewPoint(entry.Geo.Latitude, context.geo.Longitude)
+		if qc.geo != nil {
+			userPoint := geo.NewPoint(qc.geo.Latitude, qc.geo.Longitude)
+			entryPoint := geo.NewPoint(entry.Geo.Latitude, qc.geo.Longitude)
 			entry.DistanceToUser = userPoint.GreatCircleDistance(entryPoint)
 		}
 
+		if qc.route != nil {
+			entry.DistanceToRoute = qc.route.distance(entry.Geo)
+		}
+
 		dist.Update(entry.DistanceToUser)
 	}
 
@@ -182,15 +213,19 @@ func computeRecordGeo(entries []record, context queryContext) {
 		entry := &entries[index]
 
 		var nearby float64
-		if distRange > 0.0 {
+		if qc.route != nil {
+			nearby = 1.0 - entry.DistanceToRoute/qc.route.width
+			nearby = math.Max(nearby, -1.0)
+			nearby = math.Min(nearby, 1.0)
+		} else if distRange > 0.0 {
 			nearby = -((entry.DistanceToUser - distMean) / distRange)
 		}
 
 		var accessible float64
-		if context.walkingDist <= 0 {
+		if qc.walkingDist <= 0 {
 			accessible = -1.0
 		} else {
-			accessible = 1.0 - entry.DistanceToStn/context.walkingDist
+			accessible = 1.0 - entry.DistanceToStn/qc.walkingDist
 			accessible = math.Max(accessible, -1.0)
 			accessible = math.Min(accessible, 1.0)
 		}
@@ -200,67 +235,153 @@ func computeRecordGeo(entries []record, context queryContext) {
 	}
 }
 
-func computeRecordCompat(db *sql.DB, entries []record, context queryContext) error {
-	for i := range entries {
-		entry := &entries[i]
+func decayWeight(age float64, decay *decayParams) float64 {
+	if decay == nil || decay.HalfLife <= 0 {
+		return 1.0
+	}
 
-		historyRows, err := db.Query("SELECT id FROM history WHERE reviewId = (?)", entry.Id)
-		if err != nil {
-			return err
-		}
-		defer historyRows.Close()
+	return math.Pow(0.5, math.Max(age, 0)/decay.HalfLife)
+}
+
+// historyCompat accumulates compatibility samples from the history of the
+// querying user, or from that of every other user when others is set.
+func historyCompat(db *sql.DB, qc queryContext, others bool) (map[int]*compatStats, error) {
+	query := `
+		SELECT history.id, history.reviewId, JULIANDAY('now') - JULIANDAY(history.date), history.event, history.eventValue, historyGroups.categoryId, historyGroups.categoryValue
+		FROM history LEFT JOIN historyGroups ON historyGroups.historyId = history.id
+		WHERE history.id < (?)`
+
+	specs, err := loadCategorySpecs(db, qc.user)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{qc.historyCutoff(), qc.user}
+	if others {
+		query += " AND history.userId != (?)"
+	} else {
+		query += " AND history.userId = (?)"
+	}
 
+	start := time.Now()
+
+	rows, err := db.QueryContext(qc.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type historySample struct {
+		reviewId int
+		age      float64
+		weight   float64
+		profile  map[string]float64
+	}
+
+	histories := make(map[int]*historySample)
+	for rows.Next() {
 		var (
-			groupSum   float64
-			groupCount int
+			historyId, reviewId int
+			age, eventValue     float64
+			event               string
+			categoryId          sql.NullInt64
+			categoryValue       sql.NullFloat64
 		)
 
-		for historyRows.Next() {
-			var historyId int
-			if err := historyRows.Scan(&historyId); err != nil {
-				return err
-			}
-
-			groupRows, err := db.Query("SELECT categoryId, categoryValue FROM historyGroups WHERE historyId = (?)", historyId)
-			if err != nil {
-				return err
-			}
-			defer groupRows.Close()
+		if err := rows.Scan(&historyId, &reviewId, &age, &event, &eventValue, &categoryId, &categoryValue); err != nil {
+			return nil, err
+		}
 
-			recordProfile := make(map[string]float64)
-			for groupRows.Next() {
-				var (
-					categoryId    int
-					categoryValue float64
-				)
+		history, ok := histories[historyId]
+		if !ok {
+			history = &historySample{reviewId, age, eventWeight(event, eventValue, qc.eventWeights), make(map[string]float64)}
+			histories[historyId] = history
+		}
 
-				if err := groupRows.Scan(&categoryId, &categoryValue); err != nil {
-					return err
-				}
+		if categoryId.Valid {
+			history.profile[strconv.FormatInt(categoryId.Int64, 10)] = categoryValue.Float64
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-				recordProfile[strconv.Itoa(categoryId)] = categoryValue
-			}
-			if err := groupRows.Err(); err != nil {
-				return err
-			}
+	observeDB(qc.ctx, "history", start)
 
-			groupSum += semanticSimilarity(recordProfile, context.profile)
-			groupCount++
+	compats := make(map[int]*compatStats)
+	for _, history := range histories {
+		compat, ok := compats[history.reviewId]
+		if !ok {
+			compat = new(compatStats)
+			compats[history.reviewId] = compat
 		}
-		if err := historyRows.Err(); err != nil {
+
+		weight := decayWeight(history.age, qc.decay) * math.Abs(history.weight)
+		sample := math.Copysign(1, history.weight) * semanticSimilarity(history.profile, qc.profile, specs)
+		compat.update(sample, weight)
+	}
+
+	return compats, nil
+}
+
+func computeRecordCompat(db *sql.DB, entries []record, qc queryContext) error {
+	userCompats, err := historyCompat(db, qc, false)
+	if err != nil {
+		return err
+	}
+
+	var otherCompats map[int]*compatStats
+	if qc.historyBlend > 0 {
+		if otherCompats, err = historyCompat(db, qc, true); err != nil {
 			return err
 		}
+	}
+
+	// Blending pools the samples of the user with those of everyone else,
+	// weighting the latter by historyBlend and the former by its complement,
+	// so that the variance and margin describe the pooled sample.
+	blend := math.Min(qc.historyBlend, 1.0)
+	for i := range entries {
+		entry := &entries[i]
+
+		var compat compatStats
+		if userCompat, ok := userCompats[entry.Id]; ok {
+			compat = *userCompat
+		}
 
-		if groupCount > 0 {
-			entry.Compatibility = groupSum / float64(groupCount)
+		if otherCompats != nil {
+			compat = compat.scaled(1 - blend)
+			if otherCompat, ok := otherCompats[entry.Id]; ok {
+				compat.merge(otherCompat.scaled(blend))
+			}
 		}
+
+		entry.Compatibility = compat.mean(qc.compatPrior)
+		entry.CompatibilityCount = compat.count
+		entry.CompatibilityVariance = compat.variance()
+		entry.CompatibilityMargin = compat.margin()
 	}
 
 	return nil
 }
 
-func fetchRecords(db *sql.DB, context queryContext) ([]record, error) {
-	rows, err := db.Query("SELECT name, address, delicious, accommodating, affordable, atmospheric, latitude, longitude, closestStnDist, closestStnName, accessCount, id FROM reviews")
+func fetchRecords(db *sql.DB, qc queryContext) ([]record, error) {
+	return queryRecords(db, qc, "")
+}
+
+func fetchRecord(db *sql.DB, qc queryContext, id int) (*record, error) {
+	entries, err := queryRecords(db, qc, "WHERE id = (?)", id)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	return &entries[0], nil
+}
+
+func queryRecords(db *sql.DB, qc queryContext, where string, args ...interface{}) ([]record, error) {
+	start := time.Now()
+
+	rows, err := db.QueryContext(qc.ctx, "SELECT name, address, delicious, accommodating, affordable, atmospheric, latitude, longitude, closestStnDist, closestStnName, accessCount, id FROM reviews "+where, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -313,8 +434,14 @@ func fetchRecords(db *sql.DB, context queryContext) ([]record, error) {
 		return nil, err
 	}
 
-	computeRecordGeo(entries, context)
-	if err := computeRecordCompat(db, entries, context); err != nil {
+	observeDB(qc.ctx, "records", start)
+
+	computeRecordGeo(entries, qc)
+	if err := computeRecordCompat(db, entries, qc); err != nil {
+		return nil, err
+	}
+
+	if err := computeRecordCF(db, entries, qc); err != nil {
 		return nil, err
 	}
 